@@ -20,19 +20,15 @@ istioctl uninstall --purge -y
 kubectl delete namespaces istio-system
 
 # Build containers
-cd ./services/service1
-docker build -f Dockerfile            -t service1:0.6            .
-docker build -f migrations/Dockerfile -t service1-migrations:0.6 .
-cd -
-
-cd ./services/service2
-docker build -f Dockerfile            -t service2:0.6            .
-docker build -f migrations/Dockerfile -t service2-migrations:0.6 .
-cd -
-
+# Service images are built from ./services so that they can copy ./services/common
+cd ./services
+docker build -f service1/Dockerfile            -t service1:0.6            .
+docker build -f service1/migrations/Dockerfile -t service1-migrations:0.6 service1
+docker build -f service2/Dockerfile            -t service2:0.6            .
+docker build -f service2/migrations/Dockerfile -t service2-migrations:0.6 service2
 echo "Building logger"
-cd ./services/logger
-docker build -f Dockerfile -t logger:0.6 .
+docker build -f logger/Dockerfile              -t logger:0.6              .
+docker build -f logger/migrations/Dockerfile   -t logger-migrations:0.6   logger
 cd -
 
 echo "Building client"
@@ -51,6 +47,7 @@ minikube image load service2:0.6
 minikube image load service2-migrations:0.6
 echo "Pushing logger to Minikube..."
 minikube image load logger:0.6
+minikube image load logger-migrations:0.6
 echo "Pushing client to Minikube..."
 minikube image load client:0.6
 
@@ -0,0 +1,104 @@
+// Package accesslog records the outcome of HTTP requests for the access log
+// events the services publish.
+package accesslog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"time"
+
+	"common/event"
+)
+
+// RequestIDHeader carries the request ID. It is taken from the request if the
+// client or the ingress set it and is always sent back in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// Pod is the name of the pod, taken from POD_NAME or else the host name,
+// which is the pod name in Kubernetes.
+var Pod = podName()
+
+func podName() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// ResponseWriter passes a response through while recording its status code
+// and size.
+type ResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the wrapper.
+func (w *ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Status returns the status code sent, which is 200 if the handler wrote
+// nothing.
+func (w *ResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Bytes returns the number of body bytes written.
+func (w *ResponseWriter) Bytes() int64 {
+	return w.bytes
+}
+
+// RequestID returns the request ID from the RequestIDHeader of r, or a new one
+// if it has none.
+func RequestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// New builds the access log of a request served through w in duration.
+func New(r *http.Request, w *ResponseWriter, requestID string, duration time.Duration) event.AccessLog {
+	return event.AccessLog{
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		IP:        r.RemoteAddr,
+		Status:    w.Status(),
+		Bytes:     w.Bytes(),
+		Duration:  duration.Seconds(),
+		UserAgent: r.UserAgent(),
+		RequestID: requestID,
+		Pod:       Pod,
+	}
+}
@@ -0,0 +1,38 @@
+package accesslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/users?x=1", nil)
+	r.Header.Set("User-Agent", "test")
+	r.Header.Set(RequestIDHeader, "abc")
+
+	w := NewResponseWriter(httptest.NewRecorder())
+	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("hello"))
+	w.Write([]byte(" world"))
+
+	got := New(r, w, RequestID(r), 1500*time.Millisecond)
+	if got.Method != "POST" || got.Path != "/users" || got.Status != http.StatusCreated || got.Bytes != 11 ||
+		got.Duration != 1.5 || got.UserAgent != "test" || got.RequestID != "abc" || got.Pod != Pod {
+		t.Errorf("New got %+v", got)
+	}
+}
+
+func TestResponseWriterDefaults(t *testing.T) {
+	w := NewResponseWriter(httptest.NewRecorder())
+	if w.Status() != http.StatusOK || w.Bytes() != 0 {
+		t.Errorf("got status %d bytes %d want 200 and 0", w.Status(), w.Bytes())
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if id := RequestID(r); len(id) != 32 || id == RequestID(r) {
+		t.Errorf("RequestID got %q want a new random ID", id)
+	}
+}
@@ -0,0 +1,69 @@
+// Package envconfig reads the settings of the services and the logger from
+// the environment. Unset variables take the given default.
+package envconfig
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Duration reads a positive duration such as 30s from name.
+func Duration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s value: %q", name, v)
+	}
+	return d, nil
+}
+
+// Int reads a positive integer from name.
+func Int(name string, def int) (int, error) {
+	n, err := Int64(name, int64(def))
+	return int(n), err
+}
+
+// Count reads a non-negative integer from name, for settings where 0 turns
+// something off.
+func Count(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s value: %q", name, v)
+	}
+	return n, nil
+}
+
+// Bool reads a boolean such as true or 1 from name.
+func Bool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value: %q", name, v)
+	}
+	return b, nil
+}
+
+// Int64 reads a positive 64-bit integer from name.
+func Int64(name string, def int64) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s value: %q", name, v)
+	}
+	return n, nil
+}
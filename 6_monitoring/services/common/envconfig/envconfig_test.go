@@ -0,0 +1,63 @@
+package envconfig
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	if d, err := Duration("TEST_DURATION", time.Second); err != nil || d != time.Second {
+		t.Errorf("Duration got %v, %v want the default", d, err)
+	}
+	t.Setenv("TEST_DURATION", "5m")
+	if d, err := Duration("TEST_DURATION", time.Second); err != nil || d != 5*time.Minute {
+		t.Errorf("Duration got %v, %v want 5m", d, err)
+	}
+	for _, v := range []string{"soon", "0s", "-1s"} {
+		t.Setenv("TEST_DURATION", v)
+		if _, err := Duration("TEST_DURATION", time.Second); err == nil {
+			t.Errorf("Duration got no error for %q", v)
+		}
+	}
+}
+
+func TestInt(t *testing.T) {
+	if n, err := Int("TEST_INT", 10); err != nil || n != 10 {
+		t.Errorf("Int got %v, %v want the default", n, err)
+	}
+	t.Setenv("TEST_INT", "42")
+	if n, err := Int("TEST_INT", 10); err != nil || n != 42 {
+		t.Errorf("Int got %v, %v want 42", n, err)
+	}
+	for _, v := range []string{"many", "0", "-1"} {
+		t.Setenv("TEST_INT", v)
+		if _, err := Int("TEST_INT", 10); err == nil {
+			t.Errorf("Int got no error for %q", v)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	t.Setenv("TEST_COUNT", "0")
+	if n, err := Count("TEST_COUNT", 3); err != nil || n != 0 {
+		t.Errorf("Count got %v, %v want 0", n, err)
+	}
+	t.Setenv("TEST_COUNT", "-1")
+	if _, err := Count("TEST_COUNT", 3); err == nil {
+		t.Error("Count got no error for -1")
+	}
+}
+
+func TestBool(t *testing.T) {
+	if b, err := Bool("TEST_BOOL", true); err != nil || !b {
+		t.Errorf("Bool got %v, %v want the default", b, err)
+	}
+	t.Setenv("TEST_BOOL", "false")
+	if b, err := Bool("TEST_BOOL", true); err != nil || b {
+		t.Errorf("Bool got %v, %v want false", b, err)
+	}
+	t.Setenv("TEST_BOOL", "maybe")
+	if _, err := Bool("TEST_BOOL", true); err == nil {
+		t.Error("Bool got no error for maybe")
+	}
+}
@@ -0,0 +1,44 @@
+// Package etag implements the version based entity tags used by service1 and
+// service2 for conditional requests (If-Match and If-None-Match).
+package etag
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Format returns the strong entity tag of a row version.
+func Format(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// MatchStrong reports whether an If-Match header value matches tag, using the
+// strong comparison of RFC 7232 section 3.1: weak tags (W/"...") never match.
+// The header may be "*" or a comma-separated list of tags. The caller must
+// treat a missing resource as not matching, whatever the header.
+func MatchStrong(header, tag string) bool {
+	if strings.HasPrefix(tag, "W/") {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchWeak reports whether an If-None-Match header value matches tag, using
+// the weak comparison of RFC 7232 section 3.2: weak tags (W/"...") are
+// compared by their opaque value. The header may be "*" or a comma-separated
+// list of tags.
+func MatchWeak(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package etag
+
+import "testing"
+
+func TestMatchStrong(t *testing.T) {
+	cases := []struct {
+		header string
+		tag    string
+		want   bool
+	}{
+		{`"3"`, `"3"`, true},
+		{`"2", "3"`, `"3"`, true},
+		{`*`, `"1"`, true},
+		{`W/"3"`, `"3"`, false},
+		{`"3"`, `W/"3"`, false},
+		{`*`, `W/"3"`, false},
+		{`"2"`, `"3"`, false},
+		{`3`, `"3"`, false},
+	}
+
+	for _, c := range cases {
+		if got := MatchStrong(c.header, c.tag); got != c.want {
+			t.Errorf("MatchStrong(%q, %q) = %v, want %v", c.header, c.tag, got, c.want)
+		}
+	}
+}
+
+func TestMatchWeak(t *testing.T) {
+	cases := []struct {
+		header string
+		tag    string
+		want   bool
+	}{
+		{`"3"`, `"3"`, true},
+		{`"2", "3"`, `"3"`, true},
+		{`W/"3"`, `"3"`, true},
+		{`"3"`, `W/"3"`, true},
+		{`*`, `"1"`, true},
+		{`"2"`, `"3"`, false},
+		{`3`, `"3"`, false},
+	}
+
+	for _, c := range cases {
+		if got := MatchWeak(c.header, c.tag); got != c.want {
+			t.Errorf("MatchWeak(%q, %q) = %v, want %v", c.header, c.tag, got, c.want)
+		}
+	}
+}
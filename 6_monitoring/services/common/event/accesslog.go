@@ -0,0 +1,25 @@
+package event
+
+// AccessLogKind is the kind of the access log records the services publish
+// for every HTTP request.
+var AccessLogKind = Kind{Type: "AccessLog", SchemaVersion: 1}
+
+// AccessLog is the data of an AccessLogKind event. The service is the source
+// of the event. Fields other than Method, Path and IP are empty in the
+// records of older services.
+type AccessLog struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	IP     string `json:"ip"`
+	// Status is the response status code, or 0 if it is not known.
+	Status int `json:"status,omitempty"`
+	// Bytes is the size of the response body.
+	Bytes int64 `json:"bytes,omitempty"`
+	// Duration is the time taken to serve the request in seconds, or 0 if
+	// it is not known.
+	Duration  float64 `json:"duration,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	// Pod is the name of the pod that served the request.
+	Pod string `json:"pod,omitempty"`
+}
@@ -0,0 +1,148 @@
+// Package event defines the envelope of every message the services publish
+// to Kafka. It follows the CloudEvents 1.0 structured JSON format and repeats
+// the attributes as ce_* Kafka headers, so consumers can route messages
+// without decoding them and payloads can evolve behind a schema version.
+package event
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	SpecVersion = "1.0"
+	// ContentType is the content-type header of structured CloudEvents.
+	ContentType = "application/cloudevents+json"
+)
+
+var ErrInvalid = errors.New("invalid event")
+
+// Kind identifies an event type together with the version of its data
+// schema. A change to the data that is not backwards compatible must bump
+// SchemaVersion.
+type Kind struct {
+	Type          string
+	SchemaVersion int
+}
+
+// Envelope is a CloudEvents 1.0 event with the schemaversion and traceid
+// extension attributes.
+type Envelope struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	SchemaVersion   int             `json:"schemaversion"`
+	TraceID         string          `json:"traceid,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// New wraps data in an envelope with a random ID and the trace ID stored in
+// ctx.
+func New(ctx context.Context, source string, kind Kind, data interface{}) (Envelope, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		SpecVersion:     SpecVersion,
+		ID:              randomHex(16),
+		Source:          source,
+		Type:            kind.Type,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		SchemaVersion:   kind.SchemaVersion,
+		TraceID:         TraceIDFromContext(ctx),
+		Data:            raw,
+	}, nil
+}
+
+// Message encodes the envelope as a Kafka message.
+func (e Envelope) Message() kafka.Message {
+	value, _ := json.Marshal(e)
+	headers := []kafka.Header{
+		{Key: "content-type", Value: []byte(ContentType)},
+		{Key: "ce_specversion", Value: []byte(e.SpecVersion)},
+		{Key: "ce_id", Value: []byte(e.ID)},
+		{Key: "ce_source", Value: []byte(e.Source)},
+		{Key: "ce_type", Value: []byte(e.Type)},
+		{Key: "ce_time", Value: []byte(e.Time.Format(time.RFC3339Nano))},
+		{Key: "ce_schemaversion", Value: []byte(strconv.Itoa(e.SchemaVersion))},
+	}
+	if e.Subject != "" {
+		headers = append(headers, kafka.Header{Key: "ce_subject", Value: []byte(e.Subject)})
+	}
+	if e.TraceID != "" {
+		headers = append(headers, kafka.Header{Key: "ce_traceid", Value: []byte(e.TraceID)})
+	}
+	// The subject keys the message, so that a hash balancer keeps the events
+	// of an entity on one partition and in order.
+	var key []byte
+	if e.Subject != "" {
+		key = []byte(e.Subject)
+	}
+	return kafka.Message{Key: key, Value: value, Headers: headers}
+}
+
+// Decode parses a message produced by Message.
+func Decode(msg kafka.Message) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(msg.Value, &e); err != nil {
+		return e, fmt.Errorf("%w: %s", ErrInvalid, err.Error())
+	}
+	switch {
+	case e.SpecVersion != SpecVersion:
+		return e, fmt.Errorf("%w: unsupported specversion %q", ErrInvalid, e.SpecVersion)
+	case e.ID == "" || e.Source == "" || e.Type == "":
+		return e, fmt.Errorf("%w: id, source and type are required", ErrInvalid)
+	}
+	return e, nil
+}
+
+// DecodeData unmarshals the event data into v.
+func (e Envelope) DecodeData(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+type traceIDKey struct{}
+
+// WithTraceID returns a copy of ctx carrying the trace ID.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+func TraceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// RequestTraceID returns the trace ID propagated by the mesh, taken from the
+// W3C traceparent or the B3 headers, or a new one if the request has none.
+func RequestTraceID(r *http.Request) string {
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	if traceID := r.Header.Get("X-B3-TraceId"); traceID != "" {
+		return traceID
+	}
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,51 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ctx := WithTraceID(context.Background(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	e, err := New(ctx, "service1", AccessLogKind, AccessLog{Method: "GET", Path: "/users", IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Decode(e.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != e.ID || decoded.Type != "AccessLog" || decoded.SchemaVersion != 1 || decoded.TraceID != e.TraceID {
+		t.Errorf("unexpected envelope: %+v", decoded)
+	}
+
+	var data AccessLog
+	if err := decoded.DecodeData(&data); err != nil || data.Path != "/users" {
+		t.Errorf("unexpected data: %+v %v", data, err)
+	}
+}
+
+func TestDecodeRejectsForeignMessages(t *testing.T) {
+	for _, value := range []string{`not json`, `{"method":"GET","path":"/users"}`} {
+		if _, err := Decode(kafka.Message{Value: []byte(value)}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected ErrInvalid for %s, got %v", value, err)
+		}
+	}
+}
+
+func TestRequestTraceID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if got := RequestTraceID(r); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got %v want the traceparent trace ID", got)
+	}
+
+	if a, b := RequestTraceID(httptest.NewRequest("GET", "/", nil)), RequestTraceID(httptest.NewRequest("GET", "/", nil)); a == "" || a == b {
+		t.Errorf("expected distinct generated trace IDs, got %q and %q", a, b)
+	}
+}
@@ -0,0 +1,344 @@
+// Package idempotency implements Idempotency-Key handling for the POST
+// endpoints of service1 and service2. The first request with a key is
+// executed and its response stored in the idempotency_keys table; retries
+// with the same key and body within the TTL get the stored response back.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"common/accesslog"
+)
+
+const (
+	// Header is the request header carrying the client supplied key.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set on responses replayed from the store.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+)
+
+// Store keeps idempotency keys and their responses in Postgres.
+type Store struct {
+	keys  keys
+	ttl   time.Duration
+	lease time.Duration
+}
+
+// keys is the table of idempotency keys. It is an interface so that Handle
+// can be tested without Postgres.
+type keys interface {
+	// claim records key as in flight under token until lease has passed and
+	// reports whether this request owns it. Keys older than ttl and in-flight
+	// keys of the same request whose lease has run out are reclaimed.
+	claim(ctx context.Context, key, fp, token string, ttl, lease time.Duration) (bool, error)
+	// renew extends the lease on key and reports whether token still holds
+	// it.
+	renew(ctx context.Context, key, token string, lease time.Duration) (bool, error)
+	// get returns the stored entry of key, or sql.ErrNoRows.
+	get(ctx context.Context, key string) (entry, error)
+	// complete stores the response of the request owning key under token.
+	complete(ctx context.Context, key, token string, status int, headers string, body []byte) error
+	// release deletes key while it is in flight under token.
+	release(ctx context.Context, key, token string) error
+	purge(ctx context.Context, ttl time.Duration) error
+}
+
+// entry is a stored key. Status is 0 while the request is in flight.
+type entry struct {
+	fingerprint string
+	status      int
+	headers     string
+	body        []byte
+}
+
+const (
+	// defaultLease is how long a request owns its key before a retry may take
+	// it over, in case the pod handling it crashed.
+	defaultLease = 30 * time.Second
+	// storeTimeout bounds storing the response once it has been sent.
+	storeTimeout = 5 * time.Second
+)
+
+// perRequestHeaders are set anew for every request, so they are not replayed.
+var perRequestHeaders = map[string]bool{
+	http.CanonicalHeaderKey(accesslog.RequestIDHeader): true,
+}
+
+func NewStore(db *sql.DB, ttl time.Duration) *Store {
+	return &Store{keys: &pgKeys{db: db}, ttl: ttl, lease: defaultLease}
+}
+
+// Handle runs next unless r carries an Idempotency-Key that was already
+// used. A retry with the same key and request replays the stored response, a
+// reused key with a different request is rejected with 422 and a retry that
+// races the original request gets 409 until the original request finishes or
+// its lease runs out. Server errors are not stored, so the request can be
+// retried with the same key.
+func (s *Store) Handle(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := r.Header.Get(Header)
+	if key == "" {
+		next(w, r)
+		return
+	}
+	if len(key) > maxKeyLength {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s must be at most %d characters long.", Header, maxKeyLength)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Failed to read request body.")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	fp := fingerprint(r, body)
+
+	token := newToken()
+	claimed, err := s.keys.claim(r.Context(), key, fp, token, s.ttl, s.lease)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to check %s: %s", Header, err.Error())
+		return
+	}
+	if !claimed {
+		s.replay(w, r, key, fp)
+		return
+	}
+
+	stopRenewing := s.renewLease(key, token)
+	defer func() {
+		if p := recover(); p != nil {
+			stopRenewing()
+			ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			defer cancel()
+			if err := s.keys.release(ctx, key, token); err != nil {
+				log.Printf("Failed to release %s %q: %s", Header, key, err)
+			}
+			panic(p)
+		}
+	}()
+
+	rec := &recorder{ResponseWriter: w}
+	next(rec, r)
+	stopRenewing()
+
+	// Use a fresh context: the response has been sent even if the client
+	// has gone away in the meantime.
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	if rec.status >= http.StatusInternalServerError {
+		err = s.keys.release(ctx, key, token)
+	} else {
+		headers, _ := json.Marshal(rec.Header())
+		err = s.keys.complete(ctx, key, token, rec.statusCode(), string(headers), rec.body.Bytes())
+	}
+	if err != nil {
+		log.Printf("Failed to store response for %s %q: %s", Header, key, err)
+	}
+}
+
+// renewLease extends the lease on key every third of its duration, so that a
+// slow request keeps its key, until the returned function is called.
+func (s *Store) renewLease(key, token string) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(s.lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+				held, err := s.keys.renew(ctx, key, token, s.lease)
+				cancel()
+				if err != nil {
+					log.Printf("Failed to renew %s %q: %s", Header, key, err)
+				} else if !held {
+					log.Printf("Lost %s %q to a retry", Header, key)
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (s *Store) replay(w http.ResponseWriter, r *http.Request, key, fp string) {
+	stored, err := s.keys.get(r.Context(), key)
+	if err == sql.ErrNoRows {
+		// The original request failed and released the key.
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "The request with this %s failed, retry it.", Header)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to check %s: %s", Header, err.Error())
+		return
+	}
+
+	if stored.fingerprint != fp {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "%s was already used for a different request.", Header)
+		return
+	}
+	if stored.status == 0 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "A request with this %s is still being processed.", Header)
+		return
+	}
+
+	var headers http.Header
+	json.Unmarshal([]byte(stored.headers), &headers)
+	for name, values := range headers {
+		if !perRequestHeaders[name] {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(stored.status)
+	w.Write(stored.body)
+}
+
+// RunPurge deletes expired keys every interval until ctx is done.
+func (s *Store) RunPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.keys.purge(ctx, s.ttl); err != nil && ctx.Err() == nil {
+				log.Println("Failed to purge idempotency keys:", err)
+			}
+		}
+	}
+}
+
+// pgKeys stores the keys in the idempotency_keys table.
+type pgKeys struct {
+	db *sql.DB
+}
+
+func (k *pgKeys) claim(ctx context.Context, key, fp, token string, ttl, lease time.Duration) (bool, error) {
+	result, err := k.db.ExecContext(ctx, `INSERT INTO idempotency_keys (key, fingerprint, locked_until, lease_token)
+		VALUES ($1, $2, now() + $4 * interval '1 second', $5)
+		ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status = NULL, headers = NULL, body = NULL,
+			created_at = now(), locked_until = EXCLUDED.locked_until, lease_token = EXCLUDED.lease_token
+		WHERE idempotency_keys.created_at < now() - $3 * interval '1 second'
+			OR idempotency_keys.status IS NULL AND idempotency_keys.locked_until < now()
+				AND idempotency_keys.fingerprint = EXCLUDED.fingerprint`,
+		key, fp, ttl.Seconds(), lease.Seconds(), token)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (k *pgKeys) renew(ctx context.Context, key, token string, lease time.Duration) (bool, error) {
+	result, err := k.db.ExecContext(ctx, `UPDATE idempotency_keys SET locked_until = now() + $3 * interval '1 second'
+		WHERE key = $1 AND lease_token = $2 AND status IS NULL`, key, token, lease.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (k *pgKeys) get(ctx context.Context, key string) (entry, error) {
+	var (
+		e       entry
+		status  sql.NullInt64
+		headers sql.NullString
+	)
+	err := k.db.QueryRowContext(ctx, "SELECT fingerprint, status, headers, body FROM idempotency_keys WHERE key = $1", key).
+		Scan(&e.fingerprint, &status, &headers, &e.body)
+	e.status = int(status.Int64)
+	e.headers = headers.String
+	return e, err
+}
+
+func (k *pgKeys) complete(ctx context.Context, key, token string, status int, headers string, body []byte) error {
+	_, err := k.db.ExecContext(ctx, "UPDATE idempotency_keys SET status = $1, headers = $2, body = $3 WHERE key = $4 AND lease_token = $5 AND status IS NULL",
+		status, headers, body, key, token)
+	return err
+}
+
+func (k *pgKeys) release(ctx context.Context, key, token string) error {
+	_, err := k.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = $1 AND lease_token = $2 AND status IS NULL", key, token)
+	return err
+}
+
+func (k *pgKeys) purge(ctx context.Context, ttl time.Duration) error {
+	_, err := k.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < now() - $1 * interval '1 second'", ttl.Seconds())
+	return err
+}
+
+// newToken returns a random token identifying one claim of a key.
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// fingerprint identifies a request by method, path and body.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder passes a response through while keeping a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
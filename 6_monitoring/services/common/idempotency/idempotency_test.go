@@ -0,0 +1,258 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"common/accesslog"
+)
+
+func TestFingerprint(t *testing.T) {
+	r := httptest.NewRequest("POST", "/users", nil)
+	a := fingerprint(r, []byte(`{"username":"ann"}`))
+	b := fingerprint(r, []byte(`{"username":"bob"}`))
+	if a == b {
+		t.Error("requests with different bodies have the same fingerprint")
+	}
+
+	other := httptest.NewRequest("POST", "/products", nil)
+	if fingerprint(other, []byte(`{"username":"ann"}`)) == a {
+		t.Error("requests to different paths have the same fingerprint")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := &recorder{ResponseWriter: w}
+	rec.Write([]byte("created"))
+
+	if rec.statusCode() != 200 || rec.body.String() != "created" {
+		t.Errorf("unexpected recording: %d %q", rec.statusCode(), rec.body.String())
+	}
+	if w.Body.String() != "created" {
+		t.Errorf("response not passed through: %q", w.Body.String())
+	}
+}
+
+// memKeys keeps the keys in memory, like the idempotency_keys table.
+type memKeys struct {
+	mu      sync.Mutex
+	entries map[string]*memEntry
+}
+
+type memEntry struct {
+	entry
+	token       string
+	created     time.Time
+	lockedUntil time.Time
+}
+
+func (k *memKeys) claim(ctx context.Context, key, fp, token string, ttl, lease time.Duration) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if e, ok := k.entries[key]; ok {
+		expired := e.created.Before(now.Add(-ttl))
+		abandoned := e.status == 0 && e.lockedUntil.Before(now) && e.fingerprint == fp
+		if !expired && !abandoned {
+			return false, nil
+		}
+	}
+	k.entries[key] = &memEntry{entry: entry{fingerprint: fp}, token: token, created: now, lockedUntil: now.Add(lease)}
+	return true, nil
+}
+
+func (k *memKeys) renew(ctx context.Context, key, token string, lease time.Duration) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	e, ok := k.entries[key]
+	if !ok || e.token != token || e.status != 0 {
+		return false, nil
+	}
+	e.lockedUntil = time.Now().Add(lease)
+	return true, nil
+}
+
+func (k *memKeys) get(ctx context.Context, key string) (entry, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	e, ok := k.entries[key]
+	if !ok {
+		return entry{}, sql.ErrNoRows
+	}
+	return e.entry, nil
+}
+
+func (k *memKeys) complete(ctx context.Context, key, token string, status int, headers string, body []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if e, ok := k.entries[key]; ok && e.token == token && e.status == 0 {
+		e.status, e.headers, e.body = status, headers, body
+	}
+	return nil
+}
+
+func (k *memKeys) release(ctx context.Context, key, token string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if e, ok := k.entries[key]; ok && e.token == token && e.status == 0 {
+		delete(k.entries, key)
+	}
+	return nil
+}
+
+func (k *memKeys) purge(ctx context.Context, ttl time.Duration) error {
+	return nil
+}
+
+func newTestStore(lease time.Duration) *Store {
+	return &Store{keys: &memKeys{entries: make(map[string]*memEntry)}, ttl: time.Hour, lease: lease}
+}
+
+func post(s *Store, key, body string, next http.HandlerFunc) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+	r.Header.Set(Header, key)
+	r.Header.Set(accesslog.RequestIDHeader, newToken())
+	w := httptest.NewRecorder()
+	s.Handle(w, r, next)
+	return w
+}
+
+func TestHandleReplay(t *testing.T) {
+	s := newTestStore(time.Minute)
+	calls := 0
+	create := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set(accesslog.RequestIDHeader, r.Header.Get(accesslog.RequestIDHeader))
+		w.Header().Set("Location", "/users/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}
+
+	first := post(s, "k1", `{"username":"ann"}`, create)
+	retry := post(s, "k1", `{"username":"ann"}`, create)
+	if calls != 1 {
+		t.Errorf("handler ran %d times want 1", calls)
+	}
+	if retry.Code != http.StatusCreated || retry.Body.String() != "created" || retry.Header().Get("Location") != "/users/1" {
+		t.Errorf("replay got %d %q %v want the first response %d %q", retry.Code, retry.Body.String(), retry.Header(), first.Code, first.Body.String())
+	}
+	if retry.Header().Get(accesslog.RequestIDHeader) != "" {
+		t.Errorf("replay got the request ID %q of the first request", retry.Header().Get(accesslog.RequestIDHeader))
+	}
+	if retry.Header().Get(ReplayedHeader) != "true" || first.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("%s got %q on the replay and %q on the first response", ReplayedHeader, retry.Header().Get(ReplayedHeader), first.Header().Get(ReplayedHeader))
+	}
+
+	if w := post(s, "k1", `{"username":"bob"}`, create); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("changed body got %d want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times want 1", calls)
+	}
+}
+
+func TestHandleServerErrorReleasesKey(t *testing.T) {
+	s := newTestStore(time.Minute)
+	post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if w := post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) {}); w.Code != http.StatusOK {
+		t.Errorf("retry after a server error got %d want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleInFlight(t *testing.T) {
+	s := newTestStore(time.Minute)
+	started, finish := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-finish
+		})
+		close(done)
+	}()
+	<-started
+
+	if w := post(s, "k1", "{}", nil); w.Code != http.StatusConflict {
+		t.Errorf("retry while in flight got %d want %d", w.Code, http.StatusConflict)
+	}
+	close(finish)
+	<-done
+	if w := post(s, "k1", "{}", nil); w.Code != http.StatusOK || w.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("retry after the request finished got %d, replayed %q", w.Code, w.Header().Get(ReplayedHeader))
+	}
+}
+
+func TestHandleExpiredLease(t *testing.T) {
+	s := newTestStore(time.Millisecond)
+	// A request that claimed the key and never finished, as if its pod
+	// crashed.
+	r := httptest.NewRequest("POST", "/users", strings.NewReader("{}"))
+	s.keys.claim(context.Background(), "k1", fingerprint(r, []byte("{}")), "crashed", s.ttl, s.lease)
+	time.Sleep(5 * time.Millisecond)
+
+	calls := 0
+	if w := post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) { calls++ }); w.Code != http.StatusOK || calls != 1 {
+		t.Errorf("retry after the lease ran out got %d with %d calls", w.Code, calls)
+	}
+}
+
+func TestHandlePanicReleasesKey(t *testing.T) {
+	s := newTestStore(time.Minute)
+	func() {
+		defer func() { recover() }()
+		post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	}()
+	calls := 0
+	if post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) { calls++ }); calls != 1 {
+		t.Error("retry after a panic did not run the handler")
+	}
+}
+
+func TestHandleRenewsLease(t *testing.T) {
+	s := newTestStore(30 * time.Millisecond)
+	started, finish := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-finish
+		})
+		close(done)
+	}()
+	<-started
+
+	time.Sleep(100 * time.Millisecond)
+	if w := post(s, "k1", "{}", nil); w.Code != http.StatusConflict {
+		t.Errorf("retry of a slow request got %d want %d", w.Code, http.StatusConflict)
+	}
+	close(finish)
+	<-done
+}
+
+func TestReleaseKeepsNewClaim(t *testing.T) {
+	s := newTestStore(time.Minute)
+	keys := s.keys.(*memKeys)
+	post(s, "k1", "{}", func(w http.ResponseWriter, r *http.Request) {
+		// A retry takes the key over, as if the lease had not been renewed
+		// in time.
+		keys.mu.Lock()
+		e := keys.entries["k1"]
+		e.lockedUntil = time.Now()
+		keys.mu.Unlock()
+		keys.claim(context.Background(), "k1", e.fingerprint, "retry", s.ttl, s.lease)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	if e, ok := keys.entries["k1"]; !ok || e.token != "retry" {
+		t.Error("the former owner released the retry's claim")
+	}
+}
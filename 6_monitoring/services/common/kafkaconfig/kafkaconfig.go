@@ -0,0 +1,82 @@
+// Package kafkaconfig configures the Kafka writers of the services from the
+// environment.
+package kafkaconfig
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"common/envconfig"
+)
+
+// WriterConfig holds the delivery settings of a writer.
+type WriterConfig struct {
+	RequiredAcks kafka.RequiredAcks
+	Compression  kafka.Compression
+	// BatchSize and BatchTimeout bound how many messages are sent to a
+	// partition at once and how long a partial batch waits.
+	BatchSize    int
+	BatchTimeout time.Duration
+	// Async makes WriteMessages return without waiting for the brokers;
+	// failures are only reported to the writer's Completion.
+	Async bool
+}
+
+// WriterConfigFromEnv reads the writer settings. Variables and defaults:
+//
+//	KAFKA_REQUIRED_ACKS   all (none, one or all)
+//	KAFKA_COMPRESSION     none (gzip, snappy, lz4 or zstd)
+//	KAFKA_BATCH_SIZE      100
+//	KAFKA_BATCH_TIMEOUT   10ms
+//	KAFKA_ASYNC           false
+func WriterConfigFromEnv() (WriterConfig, error) {
+	cfg := WriterConfig{RequiredAcks: kafka.RequireAll, BatchSize: 100, BatchTimeout: 10 * time.Millisecond}
+	if v := os.Getenv("KAFKA_REQUIRED_ACKS"); v != "" {
+		if err := cfg.RequiredAcks.UnmarshalText([]byte(v)); err != nil {
+			return cfg, fmt.Errorf("invalid KAFKA_REQUIRED_ACKS value: %w", err)
+		}
+	}
+	if v := os.Getenv("KAFKA_COMPRESSION"); v != "" {
+		if err := cfg.Compression.UnmarshalText([]byte(v)); err != nil {
+			return cfg, fmt.Errorf("invalid KAFKA_COMPRESSION value: %w", err)
+		}
+	}
+	var err error
+	if cfg.BatchSize, err = envconfig.Int("KAFKA_BATCH_SIZE", cfg.BatchSize); err != nil {
+		return cfg, err
+	}
+	if cfg.BatchTimeout, err = envconfig.Duration("KAFKA_BATCH_TIMEOUT", cfg.BatchTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.Async, err = envconfig.Bool("KAFKA_ASYNC", false); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// NewWriter returns a writer for topic with these settings.
+func (c WriterConfig) NewWriter(brokers []string, topic string, balancer kafka.Balancer) *kafka.Writer {
+	w := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:      brokers,
+		Topic:        topic,
+		Balancer:     balancer,
+		BatchSize:    c.BatchSize,
+		BatchTimeout: c.BatchTimeout,
+		Async:        c.Async,
+	})
+	// Set after NewWriter, which treats 0 (none) as all.
+	w.RequiredAcks = c.RequiredAcks
+	w.Compression = c.Compression
+	if c.Async {
+		w.Completion = func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Printf("Failed to write %d messages to %s: %s", len(messages), topic, err)
+			}
+		}
+	}
+	return w
+}
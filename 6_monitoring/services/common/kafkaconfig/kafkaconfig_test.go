@@ -0,0 +1,101 @@
+package kafkaconfig
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestWriterConfigFromEnv(t *testing.T) {
+	cfg, err := WriterConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RequiredAcks != kafka.RequireAll || cfg.Compression != 0 || cfg.BatchSize != 100 || cfg.BatchTimeout != 10*time.Millisecond || cfg.Async {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+
+	t.Setenv("KAFKA_REQUIRED_ACKS", "none")
+	t.Setenv("KAFKA_COMPRESSION", "zstd")
+	t.Setenv("KAFKA_BATCH_SIZE", "10")
+	t.Setenv("KAFKA_BATCH_TIMEOUT", "5ms")
+	t.Setenv("KAFKA_ASYNC", "true")
+	cfg, err = WriterConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WriterConfig{RequiredAcks: kafka.RequireNone, Compression: kafka.Zstd, BatchSize: 10, BatchTimeout: 5 * time.Millisecond, Async: true}
+	if cfg != want {
+		t.Errorf("got %+v want %+v", cfg, want)
+	}
+
+	w := cfg.NewWriter([]string{"localhost:9092"}, "test", &kafka.Hash{})
+	if w.RequiredAcks != kafka.RequireNone || w.Compression != kafka.Zstd || !w.Async {
+		t.Errorf("writer does not use the config: %+v", w)
+	}
+
+	for name, value := range map[string]string{
+		"KAFKA_REQUIRED_ACKS": "2",
+		"KAFKA_COMPRESSION":   "brotli",
+		"KAFKA_BATCH_SIZE":    "0",
+		"KAFKA_BATCH_TIMEOUT": "soon",
+		"KAFKA_ASYNC":         "maybe",
+	} {
+		t.Setenv(name, value)
+		if _, err := WriterConfigFromEnv(); err == nil {
+			t.Errorf("got no error for %s=%s", name, value)
+		}
+		t.Setenv(name, "")
+	}
+}
+
+func TestCheckTopics(t *testing.T) {
+	meta := []kafka.Topic{
+		{Name: "service1_logs", Partitions: make([]kafka.Partition, 3)},
+		{Name: "service1_events", Error: kafka.UnknownTopicOrPartition},
+	}
+
+	missing, err := checkTopics(meta, []string{"service1_logs", "service1_events", "service2_logs"}, 3)
+	if err != nil || !reflect.DeepEqual(missing, []string{"service1_events", "service2_logs"}) {
+		t.Errorf("checkTopics got %v, %v want the missing topics", missing, err)
+	}
+
+	if missing, err := checkTopics(meta, []string{"service1_logs"}, 0); err != nil || missing != nil {
+		t.Errorf("checkTopics got %v, %v want no missing topics", missing, err)
+	}
+
+	if _, err := checkTopics(meta, []string{"service1_logs"}, 6); err == nil {
+		t.Error("checkTopics got no error for a wrong partition count")
+	}
+
+	meta[0].Error = kafka.TopicAuthorizationFailed
+	if _, err := checkTopics(meta, []string{"service1_logs"}, 0); !errors.Is(err, kafka.TopicAuthorizationFailed) {
+		t.Errorf("checkTopics got %v want the topic error", err)
+	}
+}
+
+func TestTopicCheckKeepsResultWhileBrokersAreDown(t *testing.T) {
+	c := NewTopicCheck([]string{"localhost:9092"}, []string{"service1_logs"}, TopicConfig{})
+	if err := c.Err(); err != errNotChecked {
+		t.Errorf("Err got %v before the first check want errNotChecked", err)
+	}
+	c.record(errors.New("dial tcp: connection refused"))
+	if err := c.Err(); err == nil {
+		t.Error("Err got nil while the brokers were never reached")
+	}
+
+	c.record(&topicError{errors.New("Kafka topics service1_logs do not exist")})
+	c.record(errors.New("dial tcp: connection refused"))
+	if err := c.Err(); err == nil || err.Error() != "Kafka topics service1_logs do not exist" {
+		t.Errorf("Err got %v want the missing topic", err)
+	}
+
+	c.record(nil)
+	c.record(errors.New("dial tcp: connection refused"))
+	if err := c.Err(); err != nil {
+		t.Errorf("Err got %v want nil while the brokers are down", err)
+	}
+}
@@ -0,0 +1,214 @@
+package kafkaconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"common/envconfig"
+)
+
+// topicError is a problem with the topics themselves, as opposed to the
+// brokers not answering.
+type topicError struct {
+	err error
+}
+
+func (e *topicError) Error() string { return e.err.Error() }
+func (e *topicError) Unwrap() error { return e.err }
+
+// TopicConfig says what the topics of a service must look like.
+type TopicConfig struct {
+	// Partitions is the expected number of partitions, 0 to accept any.
+	Partitions int
+	// Create creates missing topics, with Partitions partitions (or the
+	// broker default) and ReplicationFactor replicas. It is meant for local
+	// runs; in the cluster topics are provisioned with the Kafka chart.
+	Create            bool
+	ReplicationFactor int
+}
+
+// TopicConfigFromEnv reads the topic settings. Variables and defaults:
+//
+//	KAFKA_TOPIC_PARTITIONS          0 (any)
+//	KAFKA_CREATE_TOPICS             false
+//	KAFKA_TOPIC_REPLICATION_FACTOR  1
+func TopicConfigFromEnv() (TopicConfig, error) {
+	var cfg TopicConfig
+	var err error
+	if cfg.Partitions, err = envconfig.Count("KAFKA_TOPIC_PARTITIONS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.Create, err = envconfig.Bool("KAFKA_CREATE_TOPICS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ReplicationFactor, err = envconfig.Int("KAFKA_TOPIC_REPLICATION_FACTOR", 1); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// TopicCheck verifies that the topics a service uses exist, using the Kafka
+// admin API, and backs the readiness probe. The service is not ready until a
+// check has found the topics; a missing topic, a wrong partition count or a
+// failed creation makes it unready again. Once the topics were found,
+// unreachable brokers keep the last result, since the producers spool or
+// retry until they are back.
+type TopicCheck struct {
+	client *kafka.Client
+	topics []string
+	config TopicConfig
+
+	mu      sync.Mutex
+	checked bool
+	err     error
+}
+
+// errNotChecked is the result until a check reached the brokers.
+var errNotChecked = errors.New("Kafka topics have not been checked yet")
+
+func NewTopicCheck(brokers []string, topics []string, config TopicConfig) *TopicCheck {
+	return &TopicCheck{
+		client: &kafka.Client{Addr: kafka.TCP(brokers...), Timeout: 10 * time.Second},
+		topics: topics,
+		config: config,
+		err:    errNotChecked,
+	}
+}
+
+// Err returns why the topics are not usable, or nil if they are.
+func (c *TopicCheck) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Run checks the topics every interval until ctx is done, logging changes of
+// the result.
+func (c *TopicCheck) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := c.Check(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		c.record(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record keeps the result of a check. If the brokers could not be reached
+// after the topics were found, the last result is kept.
+func (c *TopicCheck) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var topicErr *topicError
+	if err != nil && !errors.As(err, &topicErr) {
+		if c.checked {
+			log.Println("Failed to check Kafka topics, keeping the last result:", err)
+			return
+		}
+		err = fmt.Errorf("checking Kafka topics: %w", err)
+	}
+
+	if changed := !c.checked || (err == nil) != (c.err == nil) || err != nil && err.Error() != c.err.Error(); changed {
+		if err != nil {
+			log.Println("Kafka topics are not ready:", err)
+		} else {
+			log.Println("Kafka topics are ready:", strings.Join(c.topics, ", "))
+		}
+	}
+	c.checked = true
+	c.err = err
+}
+
+// Check verifies the topics once, creating the missing ones if configured to.
+func (c *TopicCheck) Check(ctx context.Context) error {
+	if len(c.topics) == 0 {
+		return nil
+	}
+	for _, topic := range c.topics {
+		if topic == "" {
+			return &topicError{errors.New("a Kafka topic name is not configured")}
+		}
+	}
+
+	meta, err := c.client.Metadata(ctx, &kafka.MetadataRequest{Topics: c.topics})
+	if err != nil {
+		return err
+	}
+	missing, err := checkTopics(meta.Topics, c.topics, c.config.Partitions)
+	if err != nil {
+		return &topicError{err}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if !c.config.Create {
+		return &topicError{fmt.Errorf("Kafka topics %s do not exist", strings.Join(missing, ", "))}
+	}
+	return c.create(ctx, missing)
+}
+
+func (c *TopicCheck) create(ctx context.Context, topics []string) error {
+	partitions := c.config.Partitions
+	if partitions == 0 {
+		partitions = -1
+	}
+	req := &kafka.CreateTopicsRequest{}
+	for _, topic := range topics {
+		req.Topics = append(req.Topics, kafka.TopicConfig{
+			Topic:             topic,
+			NumPartitions:     partitions,
+			ReplicationFactor: c.config.ReplicationFactor,
+		})
+	}
+	res, err := c.client.CreateTopics(ctx, req)
+	if err != nil {
+		return &topicError{fmt.Errorf("creating Kafka topics %s: %w", strings.Join(topics, ", "), err)}
+	}
+	for topic, err := range res.Errors {
+		if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+			return &topicError{fmt.Errorf("creating Kafka topic %s: %w", topic, err)}
+		}
+	}
+	log.Println("Created Kafka topics", strings.Join(topics, ", "))
+	return nil
+}
+
+// checkTopics compares the metadata of topics with the wanted ones. It
+// returns the missing topics, or an error if a topic cannot be used.
+func checkTopics(meta []kafka.Topic, want []string, partitions int) ([]string, error) {
+	found := make(map[string]kafka.Topic)
+	for _, t := range meta {
+		found[t.Name] = t
+	}
+
+	var missing []string
+	for _, name := range want {
+		t, ok := found[name]
+		switch {
+		case !ok || errors.Is(t.Error, kafka.UnknownTopicOrPartition):
+			missing = append(missing, name)
+		case t.Error != nil:
+			return nil, fmt.Errorf("Kafka topic %s: %w", name, t.Error)
+		case partitions > 0 && len(t.Partitions) != partitions:
+			return nil, fmt.Errorf("Kafka topic %s has %d partitions, expected %d", name, len(t.Partitions), partitions)
+		}
+	}
+	return missing, nil
+}
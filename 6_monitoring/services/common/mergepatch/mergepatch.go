@@ -0,0 +1,62 @@
+// Package mergepatch implements JSON Merge Patch (RFC 7386), used by the
+// PATCH endpoints of service1 and service2.
+package mergepatch
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+)
+
+// ContentType is the media type of a merge patch document.
+const ContentType = "application/merge-patch+json"
+
+var ErrNotObject = errors.New("merge patch must be a JSON object")
+
+// SupportedContentType reports whether a request Content-Type may carry a
+// merge patch. Plain application/json and a missing header are accepted for
+// clients that do not set the dedicated media type.
+func SupportedContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == ContentType || mediaType == "application/json")
+}
+
+// Apply applies patch to the JSON document target and returns the result.
+// Both documents must be JSON objects.
+func Apply(target, patch []byte) ([]byte, error) {
+	var t, p interface{}
+	if err := json.Unmarshal(target, &t); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, ErrNotObject
+	}
+	return json.Marshal(merge(t, p))
+}
+
+// merge is the MergePatch function of RFC 7386, section 2.
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = merge(t[name], value)
+		}
+	}
+	return t
+}
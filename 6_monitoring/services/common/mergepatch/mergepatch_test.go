@@ -0,0 +1,46 @@
+package mergepatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Test cases from RFC 7386, appendix A.
+func TestApply(t *testing.T) {
+	cases := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, c := range cases {
+		got, err := Apply([]byte(c.target), []byte(c.patch))
+		if err != nil {
+			t.Errorf("Apply(%s, %s) failed: %v", c.target, c.patch, err)
+			continue
+		}
+
+		var gotValue, wantValue interface{}
+		json.Unmarshal(got, &gotValue)
+		json.Unmarshal([]byte(c.want), &wantValue)
+		if !reflect.DeepEqual(gotValue, wantValue) {
+			t.Errorf("Apply(%s, %s) = %s, want %s", c.target, c.patch, got, c.want)
+		}
+	}
+}
+
+func TestApplyRejectsNonObjectPatch(t *testing.T) {
+	if _, err := Apply([]byte(`{"a":"b"}`), []byte(`["c"]`)); err != ErrNotObject {
+		t.Errorf("expected ErrNotObject, got %v", err)
+	}
+}
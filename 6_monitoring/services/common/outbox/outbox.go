@@ -0,0 +1,225 @@
+// Package outbox implements the transactional outbox of service1 and
+// service2. Handlers record domain events with Add in the same transaction as
+// the data change, and a Relay publishes them to Kafka afterwards and marks
+// them sent. An event is therefore published, at least once, exactly when its
+// change was committed.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+
+	"common/event"
+)
+
+const (
+	// DefaultBatchSize is the number of events a Relay publishes at once.
+	DefaultBatchSize = 100
+
+	// sentRetention is how long published events are kept for inspection.
+	sentRetention = 7 * 24 * time.Hour
+	purgeInterval = time.Hour
+)
+
+var (
+	lagSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbox_lag_seconds",
+		Help: "Age of the oldest unpublished outbox event",
+	})
+
+	pendingEvents = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbox_pending_events",
+		Help: "Number of unpublished outbox events",
+	})
+
+	publishedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbox_events_published_total",
+		Help: "Number of outbox events published to Kafka",
+	})
+
+	publishFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbox_publish_failures_total",
+		Help: "Number of failed attempts to publish a batch of outbox events",
+	})
+)
+
+// Add records an event of the given kind about an aggregate in tx, together
+// with the trace ID stored in ctx. data is stored as JSON.
+func Add(ctx context.Context, tx *sql.Tx, aggregateType string, aggregateID int, kind event.Kind, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO outbox (aggregate_type, aggregate_id, event_type, schema_version, trace_id, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		aggregateType, strconv.Itoa(aggregateID), kind.Type, kind.SchemaVersion, event.TraceIDFromContext(ctx), string(payload))
+	return err
+}
+
+// Publisher is implemented by *kafka.Writer.
+type Publisher interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Relay publishes outbox events in insertion order. The outbox row ID is the
+// event ID, which together with source identifies an event.
+type Relay struct {
+	db        *sql.DB
+	publisher Publisher
+	source    string
+	interval  time.Duration
+	batchSize int
+}
+
+func NewRelay(db *sql.DB, publisher Publisher, source string, interval time.Duration) *Relay {
+	return &Relay{db: db, publisher: publisher, source: source, interval: interval, batchSize: DefaultBatchSize}
+}
+
+// Run publishes pending events every interval until ctx is done. Events that
+// fail to publish stay pending and are retried on the next tick.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+	for {
+		for {
+			n, err := r.publishBatch(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					publishFailuresTotal.Inc()
+					log.Println("Failed to publish outbox events:", err)
+				}
+				break
+			}
+			if n < r.batchSize {
+				break
+			}
+		}
+
+		if err := r.updateLag(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Failed to measure outbox lag:", err)
+		}
+
+		if time.Since(lastPurge) >= purgeInterval {
+			_, err := r.db.ExecContext(ctx, "DELETE FROM outbox WHERE sent_at < now() - $1 * interval '1 second'", sentRetention.Seconds())
+			if err != nil && ctx.Err() == nil {
+				log.Println("Failed to purge published outbox events:", err)
+			}
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishBatch publishes the oldest pending events and returns their number.
+// The rows stay locked until they are marked sent. Relays of other replicas
+// skip them instead of waiting behind a slow broker, and leave their turn when
+// older events are locked, so that events are not reordered.
+func (r *Relay) publishBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, aggregate_type, aggregate_id, event_type, schema_version, trace_id, created_at, payload
+		FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var msgs []kafka.Message
+	var ids []int64
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.aggregateType, &row.aggregateID, &row.eventType, &row.schemaVersion, &row.traceID, &row.createdAt, &row.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		msgs = append(msgs, r.envelope(row).Message())
+		ids = append(ids, row.id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	var oldest int64
+	if err := tx.QueryRowContext(ctx, "SELECT min(id) FROM outbox WHERE sent_at IS NULL").Scan(&oldest); err != nil {
+		return 0, err
+	}
+	if oldest < ids[0] {
+		return 0, nil
+	}
+
+	if err := r.publisher.WriteMessages(ctx, msgs...); err != nil {
+		return 0, err
+	}
+
+	// If this fails the events are published again: delivery is at least
+	// once, consumers deduplicate by event ID.
+	if _, err := tx.ExecContext(ctx, "UPDATE outbox SET sent_at = now() WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	publishedTotal.Add(float64(len(msgs)))
+	return len(msgs), nil
+}
+
+func (r *Relay) updateLag(ctx context.Context) error {
+	var pending int
+	var lag float64
+	err := r.db.QueryRowContext(ctx, `SELECT count(*), COALESCE(EXTRACT(EPOCH FROM now() - min(created_at)), 0)
+		FROM outbox WHERE sent_at IS NULL`).Scan(&pending, &lag)
+	if err != nil {
+		return err
+	}
+	pendingEvents.Set(float64(pending))
+	lagSeconds.Set(lag)
+	return nil
+}
+
+type outboxRow struct {
+	id            int64
+	aggregateType string
+	aggregateID   string
+	eventType     string
+	schemaVersion int
+	traceID       string
+	createdAt     time.Time
+	payload       string
+}
+
+func (r *Relay) envelope(row outboxRow) event.Envelope {
+	return event.Envelope{
+		SpecVersion:     event.SpecVersion,
+		ID:              strconv.FormatInt(row.id, 10),
+		Source:          r.source,
+		Type:            row.eventType,
+		Subject:         row.aggregateType + "/" + row.aggregateID,
+		Time:            row.createdAt.UTC(),
+		DataContentType: "application/json",
+		SchemaVersion:   row.schemaVersion,
+		TraceID:         row.traceID,
+		Data:            json.RawMessage(row.payload),
+	}
+}
@@ -0,0 +1,37 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"common/event"
+)
+
+func TestEnvelope(t *testing.T) {
+	r := NewRelay(nil, nil, "service1", time.Second)
+	row := outboxRow{
+		id:            42,
+		aggregateType: "user",
+		aggregateID:   "7",
+		eventType:     "UserCreated",
+		schemaVersion: 1,
+		traceID:       "4bf92f3577b34da6a3ce929d0e0e4736",
+		createdAt:     time.Date(2023, 6, 6, 12, 0, 0, 0, time.UTC),
+		payload:       `{"id":7}`,
+	}
+
+	msg := r.envelope(row).Message()
+	if string(msg.Key) != "user/7" {
+		t.Errorf("got key %q want user/7", msg.Key)
+	}
+	decoded, err := event.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != "42" || decoded.Source != "service1" || decoded.Type != "UserCreated" || decoded.Subject != "user/7" {
+		t.Errorf("unexpected envelope: %+v", decoded)
+	}
+	if decoded.TraceID != row.traceID || string(decoded.Data) != row.payload {
+		t.Errorf("unexpected envelope: %+v", decoded)
+	}
+}
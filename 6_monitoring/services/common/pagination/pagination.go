@@ -0,0 +1,173 @@
+// Package pagination implements the keyset (cursor) pagination shared by the
+// list endpoints of service1 and service2, so that both return the same
+// response envelope and accept the same limit, cursor and sort parameters.
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+var (
+	ErrInvalidLimit  = errors.New("invalid limit")
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+// Page is the response envelope of every list endpoint. NextCursor is empty
+// on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Cursor marks the last item of a page. It is bound to the sort it was
+// issued for and handed to clients as an opaque string.
+type Cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	var c Cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Sort is a sort order on a single column; ties are broken by id.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+func (s Sort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// Params are the parsed limit, sort and cursor query parameters.
+type Params struct {
+	Limit  int
+	Sort   Sort
+	Cursor *Cursor
+}
+
+// ParseParams reads limit, sort and cursor from the query. sort is a column
+// name, optionally prefixed with "-" for descending order, and must be one of
+// sortable; it defaults to id. Limits above MaxLimit are clamped.
+func ParseParams(q url.Values, sortable ...string) (Params, error) {
+	p := Params{Limit: DefaultLimit, Sort: Sort{Field: "id"}}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return p, ErrInvalidLimit
+		}
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+		p.Limit = limit
+	}
+
+	if v := q.Get("sort"); v != "" {
+		p.Sort = Sort{Field: strings.TrimPrefix(v, "-"), Desc: strings.HasPrefix(v, "-")}
+		if !contains(sortable, p.Sort.Field) && p.Sort.Field != "id" {
+			return p, ErrInvalidSort
+		}
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := DecodeCursor(v)
+		if err != nil {
+			return p, err
+		}
+		if c.Sort != p.Sort.String() {
+			return p, fmt.Errorf("%w: cursor was issued for sort %q", ErrInvalidCursor, c.Sort)
+		}
+		p.Cursor = &c
+	}
+
+	return p, nil
+}
+
+// Keyset returns the condition selecting rows after the cursor, numbering its
+// placeholders from $n, or an empty condition on the first page.
+func (p Params) Keyset(n int) (string, []interface{}) {
+	if p.Cursor == nil {
+		return "", nil
+	}
+	op := ">"
+	if p.Sort.Desc {
+		op = "<"
+	}
+	if p.Sort.Field == "id" {
+		return fmt.Sprintf("id %s $%d", op, n), []interface{}{p.Cursor.ID}
+	}
+	return fmt.Sprintf("(%s, id) %s ($%d, $%d)", p.Sort.Field, op, n, n+1), []interface{}{p.Cursor.Value, p.Cursor.ID}
+}
+
+// OrderBy returns the ORDER BY expression matching Keyset.
+func (p Params) OrderBy() string {
+	dir := "ASC"
+	if p.Sort.Desc {
+		dir = "DESC"
+	}
+	if p.Sort.Field == "id" {
+		return "id " + dir
+	}
+	return fmt.Sprintf("%s %s, id %s", p.Sort.Field, dir, dir)
+}
+
+// FetchLimit is the number of rows to query: one more than the page size, so
+// that New can tell whether another page follows.
+func (p Params) FetchLimit() int {
+	return p.Limit + 1
+}
+
+// New builds a page from up to FetchLimit items. cursor returns the sort
+// value and id of an item.
+func New[T any](items []T, p Params, cursor func(T) (string, int)) Page[T] {
+	page := Page[T]{Items: items}
+	if page.Items == nil {
+		page.Items = make([]T, 0)
+	}
+	if len(items) > p.Limit {
+		page.Items = items[:p.Limit]
+		value, id := cursor(page.Items[p.Limit-1])
+		page.NextCursor = Cursor{Sort: p.Sort.String(), Value: value, ID: id}.Encode()
+	}
+	return page
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package pagination
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseParamsDefaults(t *testing.T) {
+	p, err := ParseParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Limit != DefaultLimit || p.Sort != (Sort{Field: "id"}) || p.Cursor != nil {
+		t.Errorf("unexpected default params: %+v", p)
+	}
+	if cond, args := p.Keyset(1); cond != "" || args != nil {
+		t.Errorf("first page should have no keyset condition, got %q %v", cond, args)
+	}
+}
+
+func TestParseParamsClampsLimit(t *testing.T) {
+	p, err := ParseParams(url.Values{"limit": {"5000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Limit != MaxLimit {
+		t.Errorf("limit not clamped: got %d want %d", p.Limit, MaxLimit)
+	}
+
+	if _, err := ParseParams(url.Values{"limit": {"-1"}}); err != ErrInvalidLimit {
+		t.Errorf("expected ErrInvalidLimit, got %v", err)
+	}
+}
+
+func TestParseParamsRejectsUnknownSort(t *testing.T) {
+	if _, err := ParseParams(url.Values{"sort": {"password"}}, "name"); err != ErrInvalidSort {
+		t.Errorf("expected ErrInvalidSort, got %v", err)
+	}
+}
+
+func TestPaging(t *testing.T) {
+	type item struct {
+		ID    int
+		Price string
+	}
+	items := []item{{1, "10"}, {2, "20"}, {3, "30"}}
+
+	p, err := ParseParams(url.Values{"limit": {"2"}, "sort": {"-price"}}, "price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := New(items, p, func(i item) (string, int) { return i.Price, i.ID })
+	if len(page.Items) != 2 || page.NextCursor == "" {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+
+	next, err := ParseParams(url.Values{"limit": {"2"}, "sort": {"-price"}, "cursor": {page.NextCursor}}, "price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cond, args := next.Keyset(3)
+	if cond != "(price, id) < ($3, $4)" || !reflect.DeepEqual(args, []interface{}{"20", 2}) {
+		t.Errorf("unexpected keyset: %q %v", cond, args)
+	}
+	if orderBy := next.OrderBy(); orderBy != "price DESC, id DESC" {
+		t.Errorf("unexpected order by: %q", orderBy)
+	}
+
+	last := New(items[2:], next, func(i item) (string, int) { return i.Price, i.ID })
+	if last.NextCursor != "" {
+		t.Errorf("last page should have no next cursor, got %q", last.NextCursor)
+	}
+
+	_, err = ParseParams(url.Values{"sort": {"price"}, "cursor": {page.NextCursor}}, "price")
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("cursor reused with another sort should be rejected, got %v", err)
+	}
+}
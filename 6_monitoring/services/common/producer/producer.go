@@ -0,0 +1,388 @@
+// Package producer publishes messages to Kafka in the background through a
+// bounded queue, so that a slow broker cannot hold up or pile up requests.
+package producer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+
+	"common/envconfig"
+	"common/spool"
+)
+
+// Policy decides what happens to a message published while the queue is
+// full.
+type Policy string
+
+const (
+	// DropOldest makes room by dropping the oldest queued message.
+	DropOldest Policy = "drop-oldest"
+	// DropNewest drops the message being published.
+	DropNewest Policy = "drop-newest"
+	// Block waits up to Config.BlockTimeout for room, then drops the message.
+	Block Policy = "block"
+)
+
+// ParsePolicy parses the name of a policy.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case DropOldest, DropNewest, Block:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q, expected %s, %s or %s", s, DropOldest, DropNewest, Block)
+}
+
+// Config configures a Producer. Zero values select the defaults.
+type Config struct {
+	// QueueSize is the number of messages waiting to be written, 1000 by
+	// default.
+	QueueSize int
+	// Policy is DropNewest by default.
+	Policy       Policy
+	BlockTimeout time.Duration
+	// BatchSize is the maximum number of messages written at once, 100 by
+	// default.
+	BatchSize int
+	// FlushInterval is how long a partial batch waits for more messages,
+	// 100ms by default.
+	FlushInterval time.Duration
+	// WriteTimeout bounds writing a batch, 10s by default.
+	WriteTimeout time.Duration
+	// Spool, if set, keeps the batches that could not be written, and those
+	// queued after them, until they are replayed every ReplayInterval (5s by
+	// default).
+	Spool          *spool.Spool
+	ReplayInterval time.Duration
+}
+
+// spoolSegmentBytes is the size of the spool files.
+const spoolSegmentBytes = 1 << 20
+
+// ConfigFromEnv reads the settings of the access log queue and opens the
+// spool. Variables and defaults:
+//
+//	LOG_QUEUE_SIZE           1000
+//	LOG_QUEUE_OVERFLOW       drop-newest (drop-oldest, drop-newest or block)
+//	LOG_QUEUE_BLOCK_TIMEOUT  100ms
+//	LOG_SPOOL_DIR            none, failed batches are dropped
+//	LOG_SPOOL_MAX_BYTES      104857600 (100 MiB)
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Policy: DropNewest}
+	var err error
+	if cfg.QueueSize, err = envconfig.Int("LOG_QUEUE_SIZE", 1000); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("LOG_QUEUE_OVERFLOW"); v != "" {
+		if cfg.Policy, err = ParsePolicy(v); err != nil {
+			return cfg, fmt.Errorf("invalid LOG_QUEUE_OVERFLOW value: %w", err)
+		}
+	}
+	if cfg.BlockTimeout, err = envconfig.Duration("LOG_QUEUE_BLOCK_TIMEOUT", 100*time.Millisecond); err != nil {
+		return cfg, err
+	}
+	maxBytes, err := envconfig.Int64("LOG_SPOOL_MAX_BYTES", 100<<20)
+	if err != nil {
+		return cfg, err
+	}
+	if dir := os.Getenv("LOG_SPOOL_DIR"); dir != "" {
+		if cfg.Spool, err = spool.Open(dir, spoolSegmentBytes, maxBytes); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// Writer writes messages to Kafka, it is implemented by *kafka.Writer.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+var (
+	queueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "producer_queue_length",
+		Help: "Number of messages waiting in the producer queue",
+	}, []string{"queue"})
+
+	droppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "producer_dropped_messages_total",
+		Help: "Number of messages dropped because the producer queue was full or closed",
+	}, []string{"queue", "reason"})
+
+	failedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "producer_failed_messages_total",
+		Help: "Number of messages that could not be written to Kafka",
+	}, []string{"queue"})
+
+	writtenMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "producer_written_messages_total",
+		Help: "Number of messages written to Kafka",
+	}, []string{"queue"})
+)
+
+// Producer queues messages and writes them in batches from a single
+// goroutine.
+type Producer struct {
+	name   string
+	writer Writer
+	config Config
+	queue  chan kafka.Message
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	// closeCtx is the context passed to Close, it bounds the writes of the
+	// queued messages.
+	closeCtx   context.Context
+	done       chan struct{}
+	stopReplay context.CancelFunc
+	replayDone chan struct{}
+	// async is set for an async *kafka.Writer, whose results are counted by
+	// completed.
+	async bool
+}
+
+// ErrAsyncSpool is returned by CheckWriter for an async writer with a spool:
+// an async writer does not report failures to WriteMessages, so nothing would
+// be spooled and a replay could not tell whether it went through.
+var ErrAsyncSpool = errors.New("an async Kafka writer cannot be used with a spool, set KAFKA_ASYNC=false or unset LOG_SPOOL_DIR")
+
+// CheckWriter reports whether writer can be used with config.
+func CheckWriter(writer Writer, config Config) error {
+	if w, ok := writer.(*kafka.Writer); ok && w.Async && config.Spool != nil {
+		return ErrAsyncSpool
+	}
+	return nil
+}
+
+// New starts a producer writing to writer. The name labels its metrics.
+func New(name string, writer Writer, config Config) *Producer {
+	p := newProducer(name, writer, config)
+	// An async writer returns before the messages are written and reports
+	// the outcome to Completion instead. It cannot be combined with a spool,
+	// see ErrAsyncSpool.
+	if w, ok := writer.(*kafka.Writer); ok && w.Async {
+		p.async = true
+		w.Completion = p.completed
+	}
+	go p.run()
+	if p.config.Spool != nil {
+		var ctx context.Context
+		ctx, p.stopReplay = context.WithCancel(context.Background())
+		go func() {
+			defer close(p.replayDone)
+			p.config.Spool.Replay(ctx, writer, p.config.BatchSize, p.config.ReplayInterval)
+		}()
+	}
+	return p
+}
+
+func newProducer(name string, writer Writer, config Config) *Producer {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1000
+	}
+	if config.Policy == "" {
+		config.Policy = DropNewest
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 100 * time.Millisecond
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 10 * time.Second
+	}
+	if config.ReplayInterval <= 0 {
+		config.ReplayInterval = 5 * time.Second
+	}
+
+	return &Producer{
+		name:       name,
+		writer:     writer,
+		config:     config,
+		queue:      make(chan kafka.Message, config.QueueSize),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+		replayDone: make(chan struct{}),
+	}
+}
+
+// Publish queues msg. It only blocks with the Block policy while the queue
+// is full. Messages published after Close are dropped.
+func (p *Producer) Publish(msg kafka.Message) {
+	select {
+	case <-p.closing:
+		p.drop("closed")
+		return
+	default:
+	}
+
+	select {
+	case p.queue <- msg:
+		queueLength.WithLabelValues(p.name).Set(float64(len(p.queue)))
+		return
+	default:
+	}
+
+	switch p.config.Policy {
+	case DropOldest:
+		for {
+			select {
+			case <-p.queue:
+				p.drop("overflow")
+			default:
+			}
+			select {
+			case p.queue <- msg:
+				queueLength.WithLabelValues(p.name).Set(float64(len(p.queue)))
+				return
+			default:
+			}
+		}
+	case Block:
+		timer := time.NewTimer(p.config.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case p.queue <- msg:
+			queueLength.WithLabelValues(p.name).Set(float64(len(p.queue)))
+		case <-timer.C:
+			p.drop("timeout")
+		case <-p.closing:
+			p.drop("closed")
+		}
+	default:
+		p.drop("overflow")
+	}
+}
+
+func (p *Producer) drop(reason string) {
+	droppedMessages.WithLabelValues(p.name, reason).Inc()
+}
+
+// Close stops accepting messages and writes the queued ones, to the spool if
+// there is one and it has not been replayed yet. Writes to Kafka give up when
+// ctx is done; with a spool, the messages left are then still spooled before
+// Close returns ctx.Err(), without one Close returns ctx.Err() right away.
+func (p *Producer) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		p.closeCtx = ctx
+		close(p.closing)
+	})
+
+	var err error
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		if p.config.Spool == nil {
+			return ctx.Err()
+		}
+		<-p.done
+		err = ctx.Err()
+	}
+	if p.config.Spool != nil {
+		// Cancelling the replay aborts its write, so this does not wait
+		// for Kafka.
+		p.stopReplay()
+		<-p.replayDone
+		if closeErr := p.config.Spool.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (p *Producer) run() {
+	defer close(p.done)
+
+	batch := make([]kafka.Message, 0, p.config.BatchSize)
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-p.queue:
+			batch = append(batch, msg)
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-p.closing:
+			p.drain(batch)
+			return
+		}
+		batch = p.write(context.Background(), batch)
+	}
+}
+
+// drain writes batch and whatever is left in the queue within the context
+// passed to Close. With a spool, once a write has failed the rest is spooled
+// behind it without waiting for Kafka again.
+func (p *Producer) drain(batch []kafka.Message) {
+	for {
+		select {
+		case msg := <-p.queue:
+			batch = append(batch, msg)
+			if len(batch) == p.config.BatchSize {
+				batch = p.write(p.closeCtx, batch)
+			}
+		default:
+			p.write(p.closeCtx, batch)
+			return
+		}
+	}
+}
+
+// write writes batch within ctx and returns it emptied for reuse.
+func (p *Producer) write(ctx context.Context, batch []kafka.Message) []kafka.Message {
+	queueLength.WithLabelValues(p.name).Set(float64(len(p.queue)))
+	if len(batch) == 0 {
+		return batch
+	}
+
+	// Messages queued after spooled ones are spooled too, to keep them in
+	// order.
+	if p.config.Spool != nil && p.config.Spool.Pending() {
+		p.spool(batch)
+		return batch[:0]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.WriteTimeout)
+	err := p.writer.WriteMessages(ctx, batch...)
+	cancel()
+	if err != nil {
+		log.Printf("Failed to write %d messages to %s: %s", len(batch), p.name, err)
+		if p.config.Spool != nil {
+			p.spool(batch)
+		} else {
+			failedMessages.WithLabelValues(p.name).Add(float64(len(batch)))
+		}
+	} else if !p.async {
+		writtenMessages.WithLabelValues(p.name).Add(float64(len(batch)))
+	}
+	return batch[:0]
+}
+
+// completed counts the messages an async writer has written or failed to.
+func (p *Producer) completed(msgs []kafka.Message, err error) {
+	if err != nil {
+		log.Printf("Failed to write %d messages to %s: %s", len(msgs), p.name, err)
+		failedMessages.WithLabelValues(p.name).Add(float64(len(msgs)))
+		return
+	}
+	writtenMessages.WithLabelValues(p.name).Add(float64(len(msgs)))
+}
+
+func (p *Producer) spool(batch []kafka.Message) {
+	if err := p.config.Spool.Append(batch); err != nil {
+		log.Printf("Failed to spool %d messages of %s: %s", len(batch), p.name, err)
+		failedMessages.WithLabelValues(p.name).Add(float64(len(batch)))
+	}
+}
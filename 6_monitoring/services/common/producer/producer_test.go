@@ -0,0 +1,271 @@
+package producer
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+
+	"common/spool"
+)
+
+type fakeWriter struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var batch []string
+	for _, msg := range msgs {
+		batch = append(batch, string(msg.Value))
+	}
+	w.batches = append(w.batches, batch)
+	return nil
+}
+
+func message(value string) kafka.Message {
+	return kafka.Message{Value: []byte(value)}
+}
+
+// queued returns the values in the queue of a producer that is not running.
+func queued(p *Producer) []string {
+	var values []string
+	for len(p.queue) > 0 {
+		values = append(values, string((<-p.queue).Value))
+	}
+	return values
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		want   []string
+	}{
+		{DropNewest, []string{"1", "2"}},
+		{DropOldest, []string{"2", "3"}},
+		{Block, []string{"1", "2"}},
+	}
+	for _, test := range tests {
+		p := newProducer("test", &fakeWriter{}, Config{QueueSize: 2, Policy: test.policy, BlockTimeout: time.Millisecond})
+		for _, value := range []string{"1", "2", "3"} {
+			p.Publish(message(value))
+		}
+		if got := testutil.ToFloat64(queueLength.WithLabelValues("test")); got != 2 {
+			t.Errorf("%s: queue length gauge got %v want 2", test.policy, got)
+		}
+		if got := queued(p); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v want %v", test.policy, got, test.want)
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	p := newProducer("test", &fakeWriter{}, Config{QueueSize: 1, Policy: Block, BlockTimeout: time.Second})
+	p.Publish(message("1"))
+
+	published := make(chan struct{})
+	go func() {
+		p.Publish(message("2"))
+		close(published)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	<-p.queue
+	<-published
+	if got := queued(p); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("got %v want [2]", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	w := &fakeWriter{}
+	p := newProducer("test", w, Config{QueueSize: 10, BatchSize: 2, FlushInterval: time.Hour})
+	for _, value := range []string{"1", "2", "3"} {
+		p.Publish(message(value))
+	}
+	go p.run()
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.Publish(message("4"))
+
+	var got []string
+	for _, batch := range w.batches {
+		if len(batch) > 2 {
+			t.Errorf("got a batch of %d messages want at most 2", len(batch))
+		}
+		got = append(got, batch...)
+	}
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+// blockingWriter blocks until the write is cancelled.
+type blockingWriter struct {
+	started  chan struct{}
+	finished atomic.Bool
+}
+
+func (w *blockingWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	close(w.started)
+	<-ctx.Done()
+	time.Sleep(10 * time.Millisecond)
+	w.finished.Store(true)
+	return ctx.Err()
+}
+
+func TestCloseWaitsForReplay(t *testing.T) {
+	s, err := spool.Open(t.TempDir(), 1000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]kafka.Message{message("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &blockingWriter{started: make(chan struct{})}
+	p := New("test", w, Config{Spool: s, ReplayInterval: time.Millisecond})
+	<-w.started
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !w.finished.Load() {
+		t.Error("Close returned before the replay finished")
+	}
+}
+
+func TestAsyncWriter(t *testing.T) {
+	// Nothing listens on port 1, so every write fails.
+	w := &kafka.Writer{Addr: kafka.TCP("127.0.0.1:1"), Topic: "test", Async: true, MaxAttempts: 1, BatchTimeout: time.Millisecond}
+	s, err := spool.Open(t.TempDir(), 1000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := CheckWriter(w, Config{Spool: s}); err != ErrAsyncSpool {
+		t.Errorf("CheckWriter got %v want ErrAsyncSpool", err)
+	}
+
+	failed := testutil.ToFloat64(failedMessages.WithLabelValues("async"))
+	p := New("async", w, Config{FlushInterval: time.Millisecond})
+	p.Publish(message("1"))
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w.Close() // waits for the pending writes
+	if got := testutil.ToFloat64(failedMessages.WithLabelValues("async")) - failed; got != 1 {
+		t.Errorf("failed messages got %v want 1", got)
+	}
+	if got := testutil.ToFloat64(writtenMessages.WithLabelValues("async")); got != 0 {
+		t.Errorf("written messages got %v want 0", got)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	if p, err := ParsePolicy("drop-oldest"); err != nil || p != DropOldest {
+		t.Errorf("ParsePolicy got %q, %v want %q", p, err, DropOldest)
+	}
+	if _, err := ParsePolicy("drop-all"); err == nil {
+		t.Error("ParsePolicy got no error for an unknown policy")
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QueueSize != 1000 || cfg.Policy != DropNewest || cfg.BlockTimeout != 100*time.Millisecond || cfg.Spool != nil {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+
+	dir := t.TempDir()
+	t.Setenv("LOG_QUEUE_SIZE", "10")
+	t.Setenv("LOG_QUEUE_OVERFLOW", "block")
+	t.Setenv("LOG_QUEUE_BLOCK_TIMEOUT", "1s")
+	t.Setenv("LOG_SPOOL_DIR", dir)
+	cfg, err = ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QueueSize != 10 || cfg.Policy != Block || cfg.BlockTimeout != time.Second || cfg.Spool == nil {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	cfg.Spool.Close()
+
+	for name, value := range map[string]string{
+		"LOG_QUEUE_SIZE":          "0",
+		"LOG_QUEUE_OVERFLOW":      "drop-all",
+		"LOG_QUEUE_BLOCK_TIMEOUT": "soon",
+		"LOG_SPOOL_MAX_BYTES":     "-1",
+	} {
+		t.Setenv(name, value)
+		if _, err := ConfigFromEnv(); err == nil {
+			t.Errorf("got no error for %s=%s", name, value)
+		}
+		t.Setenv(name, "")
+	}
+}
+
+// downWriter fails every write once it is cancelled, like a writer whose
+// brokers are unreachable.
+type downWriter struct {
+	calls atomic.Int32
+}
+
+func (w *downWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.calls.Add(1)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCloseSpoolsWhileKafkaIsDown(t *testing.T) {
+	dir := t.TempDir()
+	s, err := spool.Open(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &downWriter{}
+	p := New("down", w, Config{BatchSize: 100, FlushInterval: time.Hour, WriteTimeout: time.Hour, Spool: s, ReplayInterval: time.Hour})
+	for i := 0; i < 250; i++ {
+		p.Publish(message("m"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Close got %v want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %s", elapsed)
+	}
+	if calls := w.calls.Load(); calls != 1 {
+		t.Errorf("got %d writes want 1, the rest should be spooled", calls)
+	}
+
+	// Everything queued is in the spool.
+	s, err = spool.Open(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	replayed := &fakeWriter{}
+	replayCtx, stopReplay := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer stopReplay()
+	s.Replay(replayCtx, replayed, 100, time.Millisecond)
+	n := 0
+	for _, batch := range replayed.batches {
+		n += len(batch)
+	}
+	if n != 250 {
+		t.Errorf("spooled %d messages want 250", n)
+	}
+}
@@ -0,0 +1,159 @@
+// Package softdelete holds the helpers shared by the soft-deletable tables of
+// service1 and service2: the include_deleted query parameter, restoring rows
+// and the job that purges rows once their retention period is over.
+package softdelete
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var purgedRows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "soft_deleted_rows_purged_total",
+	Help: "Number of soft-deleted rows removed permanently after their retention period",
+}, []string{"table"})
+
+// IncludeDeleted reports whether the request asks for soft-deleted rows with
+// ?include_deleted=true.
+func IncludeDeleted(r *http.Request) bool {
+	include, _ := strconv.ParseBool(r.URL.Query().Get("include_deleted"))
+	return include
+}
+
+// ErrNotDeleted is returned by Restore for a row that is not deleted.
+var ErrNotDeleted = errors.New("row is not deleted")
+
+// Restore clears deleted_at of row id of table within tx, bumping its
+// version, and passes the returned columns to scan. It returns sql.ErrNoRows
+// if there is no such row.
+func Restore(ctx context.Context, tx *sql.Tx, table string, id int, columns string, scan func(*sql.Row) error) error {
+	row := tx.QueryRowContext(ctx, "UPDATE "+table+" SET deleted_at = NULL, version = version + 1 WHERE id = $1 AND deleted_at IS NOT NULL RETURNING "+columns, id)
+	err := scan(row)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+table+" WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrNotDeleted
+	}
+	return sql.ErrNoRows
+}
+
+// Table describes a soft-deletable table to the purge job. Rows that are
+// still referenced are kept, so that the orders pointing to them keep
+// resolving.
+type Table struct {
+	Name string
+	// Referenced is an SQL condition on a row that holds while rows of the
+	// same database refer to it.
+	Referenced string
+	// InUse returns which of ids are still referred to from another
+	// service. Nothing is purged while it fails.
+	InUse func(ctx context.Context, ids []int64) ([]int64, error)
+}
+
+// RunPurge permanently deletes the unreferenced rows of table that were
+// soft-deleted more than retention ago, checking every interval until ctx is
+// done.
+func RunPurge(ctx context.Context, db *sql.DB, table Table, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := Purge(ctx, db, table, retention)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to purge soft-deleted rows from %s: %s", table.Name, err)
+			}
+			continue
+		}
+		if n > 0 {
+			purgedRows.WithLabelValues(table.Name).Add(float64(n))
+			log.Printf("Purged %d soft-deleted rows from %s", n, table.Name)
+		}
+	}
+}
+
+// Purge runs the purge of table once and returns the number of rows deleted.
+func Purge(ctx context.Context, db *sql.DB, table Table, retention time.Duration) (int64, error) {
+	where := "deleted_at < now() - $1 * interval '1 second'"
+	if table.Referenced != "" {
+		where += " AND NOT (" + table.Referenced + ")"
+	}
+
+	if table.InUse == nil {
+		result, err := db.ExecContext(ctx, "DELETE FROM "+table.Name+" WHERE "+where, retention.Seconds())
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id FROM "+table.Name+" WHERE "+where, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	inUse, err := table.InUse(ctx, ids)
+	if err != nil {
+		return 0, fmt.Errorf("checking references: %w", err)
+	}
+	ids = without(ids, inUse)
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	// The conditions are checked again in case a row was restored or
+	// referenced in the meantime.
+	result, err := db.ExecContext(ctx, "DELETE FROM "+table.Name+" WHERE "+where+" AND id = ANY($2)", retention.Seconds(), pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// without returns ids minus the ones in exclude.
+func without(ids, exclude []int64) []int64 {
+	skip := make(map[int64]bool, len(exclude))
+	for _, id := range exclude {
+		skip[id] = true
+	}
+	kept := ids[:0]
+	for _, id := range ids {
+		if !skip[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,208 @@
+package softdelete
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDB is a database/sql driver that records the statements it runs and
+// answers them with result.
+type fakeDB struct {
+	queries []string
+	args    [][]driver.Value
+	result  func(query string) (columns []string, rows [][]driver.Value, err error)
+}
+
+func (f *fakeDB) open() *sql.DB { return sql.OpenDB(f) }
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c fakeConn) Commit() error             { return nil }
+func (c fakeConn) Rollback() error           { return nil }
+
+func (c fakeConn) run(query string, named []driver.NamedValue) ([]string, [][]driver.Value, error) {
+	args := make([]driver.Value, len(named))
+	for i, arg := range named {
+		args[i] = arg.Value
+	}
+	c.db.queries = append(c.db.queries, query)
+	c.db.args = append(c.db.args, args)
+	return c.db.result(query)
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	columns, rows, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, rows, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(rows)), nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func ids(values ...int64) [][]driver.Value {
+	var rows [][]driver.Value
+	for _, v := range values {
+		rows = append(rows, []driver.Value{v})
+	}
+	return rows
+}
+
+func TestIncludeDeleted(t *testing.T) {
+	for target, want := range map[string]bool{
+		"/users":                       false,
+		"/users?include_deleted=true":  true,
+		"/users?include_deleted=1":     true,
+		"/users?include_deleted=false": false,
+		"/users?include_deleted=yes":   false,
+	} {
+		if got := IncludeDeleted(httptest.NewRequest("GET", target, nil)); got != want {
+			t.Errorf("IncludeDeleted(%s) got %v want %v", target, got, want)
+		}
+	}
+}
+
+func TestPurgeSkipsReferencedRows(t *testing.T) {
+	f := &fakeDB{result: func(string) ([]string, [][]driver.Value, error) {
+		return nil, ids(4, 5), nil
+	}}
+	table := Table{Name: "users", Referenced: "EXISTS (SELECT 1 FROM orders WHERE orders.user_id = users.id)"}
+
+	n, err := Purge(context.Background(), f.open(), table, time.Hour)
+	if err != nil || n != 2 {
+		t.Fatalf("Purge got %d, %v want 2 rows", n, err)
+	}
+	if len(f.queries) != 1 || !strings.HasPrefix(f.queries[0], "DELETE FROM users WHERE deleted_at < ") ||
+		!strings.HasSuffix(f.queries[0], " AND NOT ("+table.Referenced+")") {
+		t.Errorf("unexpected statements %q", f.queries)
+	}
+	if !reflect.DeepEqual(f.args[0], []driver.Value{3600.0}) {
+		t.Errorf("got arguments %v want the retention in seconds", f.args[0])
+	}
+}
+
+func TestPurgeKeepsRowsInUse(t *testing.T) {
+	f := &fakeDB{result: func(query string) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "SELECT") {
+			return []string{"id"}, ids(1, 2, 3), nil
+		}
+		return nil, ids(1, 3), nil
+	}}
+	var checked []int64
+	table := Table{Name: "products", InUse: func(ctx context.Context, ids []int64) ([]int64, error) {
+		checked = append(checked, ids...)
+		return []int64{2}, nil
+	}}
+
+	n, err := Purge(context.Background(), f.open(), table, time.Hour)
+	if err != nil || n != 2 {
+		t.Fatalf("Purge got %d, %v want 2 rows", n, err)
+	}
+	if !reflect.DeepEqual(checked, []int64{1, 2, 3}) {
+		t.Errorf("InUse got %v want all candidates", checked)
+	}
+	if len(f.queries) != 2 || !strings.HasPrefix(f.queries[1], "DELETE FROM products WHERE deleted_at < ") {
+		t.Fatalf("unexpected statements %q", f.queries)
+	}
+	if got := f.args[1][1]; got != "{1,3}" {
+		t.Errorf("deleted %v want {1,3}", got)
+	}
+}
+
+func TestPurgeStopsWhenInUseFails(t *testing.T) {
+	f := &fakeDB{result: func(query string) ([]string, [][]driver.Value, error) {
+		return []string{"id"}, ids(1), nil
+	}}
+	table := Table{Name: "products", InUse: func(ctx context.Context, ids []int64) ([]int64, error) {
+		return nil, errors.New("service1 unavailable")
+	}}
+
+	if _, err := Purge(context.Background(), f.open(), table, time.Hour); err == nil {
+		t.Error("Purge got no error")
+	}
+	if len(f.queries) != 1 {
+		t.Errorf("got statements %q want only the SELECT", f.queries)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		restored bool
+		exists   bool
+		want     error
+	}{
+		{"deleted", true, true, nil},
+		{"not deleted", false, true, ErrNotDeleted},
+		{"missing", false, false, sql.ErrNoRows},
+	} {
+		f := &fakeDB{result: func(query string) ([]string, [][]driver.Value, error) {
+			if strings.HasPrefix(query, "UPDATE") {
+				if tt.restored {
+					return []string{"id", "version"}, [][]driver.Value{{int64(7), int64(3)}}, nil
+				}
+				return []string{"id", "version"}, nil, nil
+			}
+			return []string{"exists"}, [][]driver.Value{{tt.exists}}, nil
+		}}
+		db := f.open()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var id, version int
+		err = Restore(context.Background(), tx, "users", 7, "id, version", func(row *sql.Row) error {
+			return row.Scan(&id, &version)
+		})
+		if err != tt.want {
+			t.Errorf("%s: Restore got %v want %v", tt.name, err, tt.want)
+		}
+		if tt.restored && (id != 7 || version != 3) {
+			t.Errorf("%s: scanned %d, %d want 7, 3", tt.name, id, version)
+		}
+		if !strings.HasPrefix(f.queries[0], "UPDATE users SET deleted_at = NULL, version = version + 1 WHERE id = $1 AND deleted_at IS NOT NULL") {
+			t.Errorf("%s: unexpected statement %q", tt.name, f.queries[0])
+		}
+		tx.Rollback()
+	}
+}
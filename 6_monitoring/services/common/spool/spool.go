@@ -0,0 +1,339 @@
+// Package spool keeps messages that could not be written to Kafka in segment
+// files on disk and replays them in order once Kafka is reachable again.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+// segmentExt is the extension of segment files, which are named by their
+// sequence number so that they sort in the order they were written.
+const segmentExt = ".seg"
+
+// maxRejections is how many times in a row Kafka may reject a batch for good,
+// e.g. because a message is too large, before the batch is dropped so that it
+// does not block the messages behind it.
+const maxRejections = 3
+
+// ErrFull is returned by Append when the spool has reached its size limit.
+var ErrFull = errors.New("spool is full")
+
+var (
+	spoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "spool_bytes",
+		Help: "Size of the messages waiting in the spool",
+	})
+
+	spoolSegments = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "spool_segments",
+		Help: "Number of segment files in the spool",
+	})
+
+	spooledMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_spooled_messages_total",
+		Help: "Number of messages written to the spool",
+	})
+
+	replayedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_replayed_messages_total",
+		Help: "Number of spooled messages written to Kafka",
+	})
+
+	replayFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_replay_failures_total",
+		Help: "Number of failed attempts to write spooled messages to Kafka",
+	})
+
+	droppedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_dropped_messages_total",
+		Help: "Number of spooled messages dropped because Kafka kept rejecting them",
+	})
+)
+
+// Writer writes messages to Kafka, it is implemented by *kafka.Writer.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// record is a spooled message, stored as a line of JSON.
+type record struct {
+	Key     []byte         `json:"key,omitempty"`
+	Value   []byte         `json:"value"`
+	Headers []kafka.Header `json:"headers,omitempty"`
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Spool appends messages to the newest segment and replays the oldest.
+type Spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	mu       sync.Mutex
+	segments []segment // oldest first
+	size     int64
+	// current is open for appending to the last segment, nil if that one
+	// is sealed and the next Append starts a new segment.
+	current *os.File
+}
+
+// Open opens the spool in dir, creating it if needed. Segments are closed once
+// they exceed segmentBytes and Append fails once the spool holds maxBytes.
+func Open(dir string, segmentBytes, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, segmentBytes: segmentBytes, maxBytes: maxBytes}
+	for _, entry := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExt), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), segmentExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, segment{seq: seq, size: info.Size()})
+		s.size += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if len(s.segments) > 0 {
+		log.Printf("Spool %s holds %d bytes in %d segments", dir, s.size, len(s.segments))
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+// Pending reports whether there are messages waiting to be replayed. New
+// messages should be appended while there are, to keep them in order.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) > 0
+}
+
+// Append writes msgs to the spool, all of them or none if it would exceed the
+// size limit.
+func (s *Spool) Append(msgs []kafka.Message) error {
+	var buf []byte
+	for _, msg := range msgs {
+		line, err := json.Marshal(record{Key: msg.Key, Value: msg.Value, Headers: msg.Headers})
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	size := int64(len(buf))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size+size > s.maxBytes {
+		return ErrFull
+	}
+	last := len(s.segments) - 1
+	if s.current == nil || s.segments[last].size >= s.segmentBytes {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+		last = len(s.segments) - 1
+	}
+	if _, err := s.current.Write(buf); err != nil {
+		return err
+	}
+	s.segments[last].size += size
+	s.size += size
+	spooledMessages.Add(float64(len(msgs)))
+	s.updateMetrics()
+	return nil
+}
+
+// startSegment closes the current segment and opens a new one.
+func (s *Spool) startSegment() error {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	var seq uint64 = 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	f, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	s.current = f
+	s.segments = append(s.segments, segment{seq: seq})
+	return nil
+}
+
+// Replay writes the spooled messages to w in batches of batchSize, oldest
+// segment first, until ctx is done. Failed writes are retried every interval;
+// a batch Kafka rejects maxRejections times in a row is dropped. A segment is
+// removed once all of its messages are written.
+func (s *Spool) Replay(ctx context.Context, w Writer, batchSize int, interval time.Duration) {
+	for {
+		seg, ok := s.oldest()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			continue
+		}
+
+		msgs, err := readSegment(s.path(seg.seq))
+		if err != nil {
+			log.Printf("Failed to read spool segment %d, dropping it: %s", seg.seq, err)
+		}
+		rejections := 0
+		for len(msgs) > 0 {
+			n := batchSize
+			if n > len(msgs) {
+				n = len(msgs)
+			}
+			if err := w.WriteMessages(ctx, msgs[:n]...); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				replayFailures.Inc()
+				if rejected(err) {
+					rejections++
+				}
+				if rejections >= maxRejections {
+					log.Printf("Dropping %d spooled messages Kafka keeps rejecting: %s", n, err)
+					droppedMessages.Add(float64(n))
+					msgs = msgs[n:]
+					rejections = 0
+					continue
+				}
+				log.Printf("Failed to replay spooled messages, retrying in %s: %s", interval, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+				continue
+			}
+			replayedMessages.Add(float64(n))
+			msgs = msgs[n:]
+			rejections = 0
+		}
+		s.remove(seg)
+	}
+}
+
+// rejected reports whether err means that Kafka will not take the messages
+// however often they are retried, as opposed to it being unreachable.
+func rejected(err error) bool {
+	var tooLarge kafka.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return true
+	}
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) {
+		for _, err := range writeErrs {
+			if err != nil && rejected(err) {
+				return true
+			}
+		}
+		return false
+	}
+	var kafkaErr kafka.Error
+	return errors.As(err, &kafkaErr) && !kafkaErr.Temporary()
+}
+
+// oldest returns the oldest segment, sealing it if it is still being
+// appended to.
+func (s *Spool) oldest() (segment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 {
+		return segment{}, false
+	}
+	if len(s.segments) == 1 && s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	return s.segments[0], true
+}
+
+func (s *Spool) remove(seg segment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(seg.seq)); err != nil {
+		log.Printf("Failed to remove spool segment %d: %s", seg.seq, err)
+	}
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+	s.updateMetrics()
+}
+
+// Close closes the segment being appended to.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func (s *Spool) updateMetrics() {
+	spoolBytes.Set(float64(s.size))
+	spoolSegments.Set(float64(len(s.segments)))
+}
+
+// readSegment reads the messages of a segment. A line cut short by a crash
+// ends the segment.
+func readSegment(path string) ([]kafka.Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var msgs []kafka.Message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Skipping the rest of spool segment %s: %s", filepath.Base(path), err)
+			break
+		}
+		msgs = append(msgs, kafka.Message{Key: rec.Key, Value: rec.Value, Headers: rec.Headers})
+	}
+	return msgs, scanner.Err()
+}
@@ -0,0 +1,172 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// flakyWriter fails the first write and then collects the message values.
+type flakyWriter struct {
+	mu     sync.Mutex
+	failed bool
+	values []string
+}
+
+func (w *flakyWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.failed {
+		w.failed = true
+		return errors.New("broker unavailable")
+	}
+	for _, msg := range msgs {
+		w.values = append(w.values, string(msg.Value))
+	}
+	return nil
+}
+
+// rejectingWriter rejects batches holding the value "bad" for good and
+// collects the other values.
+type rejectingWriter struct {
+	mu       sync.Mutex
+	attempts int
+	values   []string
+}
+
+func (w *rejectingWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, msg := range msgs {
+		if string(msg.Value) == "bad" {
+			w.attempts++
+			return kafka.MessageSizeTooLarge
+		}
+	}
+	for _, msg := range msgs {
+		w.values = append(w.values, string(msg.Value))
+	}
+	return nil
+}
+
+func messages(values ...string) []kafka.Message {
+	var msgs []kafka.Message
+	for _, value := range values {
+		msgs = append(msgs, kafka.Message{Value: []byte(value)})
+	}
+	return msgs
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 40, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Pending() {
+		t.Error("new spool is pending")
+	}
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		if err := s.Append(messages(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append(messages(string(make([]byte, 1000)))); err != ErrFull {
+		t.Errorf("Append got %v want ErrFull", err)
+	}
+	s.Close()
+
+	// Segments written before a restart are replayed first.
+	s, err = Open(dir, 40, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.segments) < 2 || !s.Pending() {
+		t.Fatalf("got %d segments want several", len(s.segments))
+	}
+	if err := s.Append(messages("6", "7")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &flakyWriter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Replay(ctx, w, 2, time.Millisecond)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); s.Pending() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if want := []string{"1", "2", "3", "4", "5", "6", "7"}; !reflect.DeepEqual(w.values, want) {
+		t.Errorf("replayed %v want %v", w.values, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 || s.size != 0 {
+		t.Errorf("got %d files and size %d left after replay", len(entries), s.size)
+	}
+}
+
+func TestReplayDropsRejectedBatch(t *testing.T) {
+	s, err := Open(t.TempDir(), 1000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Append(messages("1", "bad", "3")); err != nil {
+		t.Fatal(err)
+	}
+	dropped := testutil.ToFloat64(droppedMessages)
+
+	w := &rejectingWriter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Replay(ctx, w, 1, time.Millisecond)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); s.Pending() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if want := []string{"1", "3"}; !reflect.DeepEqual(w.values, want) {
+		t.Errorf("replayed %v want %v", w.values, want)
+	}
+	if w.attempts != maxRejections {
+		t.Errorf("the rejected batch was tried %d times want %d", w.attempts, maxRejections)
+	}
+	if got := testutil.ToFloat64(droppedMessages) - dropped; got != 1 {
+		t.Errorf("dropped %v messages want 1", got)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{kafka.MessageSizeTooLarge, true},
+		{kafka.MessageTooLargeError{}, true},
+		{kafka.WriteErrors{nil, kafka.TopicAuthorizationFailed}, true},
+		{kafka.WriteErrors{kafka.LeaderNotAvailable}, false},
+		{kafka.LeaderNotAvailable, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, test := range tests {
+		if got := rejected(test.err); got != test.want {
+			t.Errorf("rejected(%v) got %v want %v", test.err, got, test.want)
+		}
+	}
+}
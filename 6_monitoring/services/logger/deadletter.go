@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+
+	"common/event"
+)
+
+// Headers added to dead-lettered messages, next to the original ones.
+const (
+	headerDeadLetterError     = "dlq-error"
+	headerDeadLetterTopic     = "dlq-topic"
+	headerDeadLetterPartition = "dlq-partition"
+	headerDeadLetterOffset    = "dlq-offset"
+)
+
+var deadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "logger_dead_lettered_messages_total",
+	Help: "Number of malformed or skipped messages sent to the dead-letter topic per source topic",
+}, []string{"topic"})
+
+// publisher sends messages to Kafka, it is implemented by *kafka.Writer.
+type publisher interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// decodeAccessLog decodes and validates the data of an access log event.
+func decodeAccessLog(e event.Envelope) (event.AccessLog, error) {
+	var data event.AccessLog
+	if e.SchemaVersion > event.AccessLogKind.SchemaVersion {
+		return data, fmt.Errorf("unsupported schema version %d", e.SchemaVersion)
+	}
+	if err := e.DecodeData(&data); err != nil {
+		return data, fmt.Errorf("invalid data: %w", err)
+	}
+
+	var problems []string
+	if e.Time.IsZero() {
+		problems = append(problems, "time is required")
+	}
+	if data.Method == "" || strings.ToUpper(data.Method) != data.Method {
+		problems = append(problems, fmt.Sprintf("invalid method %q", data.Method))
+	}
+	if !strings.HasPrefix(data.Path, "/") {
+		problems = append(problems, fmt.Sprintf("invalid path %q", data.Path))
+	}
+	if data.Status != 0 && (data.Status < 100 || data.Status > 599) {
+		problems = append(problems, fmt.Sprintf("invalid status %d", data.Status))
+	}
+	if data.Bytes < 0 {
+		problems = append(problems, fmt.Sprintf("invalid bytes %d", data.Bytes))
+	}
+	if data.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("invalid duration %g", data.Duration))
+	}
+	if len(problems) > 0 {
+		return data, errors.New(strings.Join(problems, ", "))
+	}
+	return data, nil
+}
+
+// deadLetterMessage copies msg for the dead-letter topic, adding headers with
+// the reason it was rejected and where it was read from.
+func deadLetterMessage(msg kafka.Message, reason error) kafka.Message {
+	headers := append([]kafka.Header(nil), msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: headerDeadLetterError, Value: []byte(reason.Error())},
+		kafka.Header{Key: headerDeadLetterTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: headerDeadLetterPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: headerDeadLetterOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+	)
+	return kafka.Message{Key: msg.Key, Value: msg.Value, Headers: headers}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+
+	"common/event"
+)
+
+func TestDecodeAccessLog(t *testing.T) {
+	valid := event.AccessLog{Method: "GET", Path: "/users/1", IP: "10.0.0.1", Status: 200}
+	tests := []struct {
+		name  string
+		data  interface{}
+		valid bool
+	}{
+		{"valid", valid, true},
+		{"unknown status", event.AccessLog{Method: "GET", Path: "/users"}, true},
+		{"not an object", "GET /users", false},
+		{"no method", event.AccessLog{Path: "/users"}, false},
+		{"lowercase method", event.AccessLog{Method: "get", Path: "/users"}, false},
+		{"relative path", event.AccessLog{Method: "GET", Path: "users"}, false},
+		{"bad status", event.AccessLog{Method: "GET", Path: "/users", Status: 42}, false},
+		{"negative duration", event.AccessLog{Method: "GET", Path: "/users", Duration: -1}, false},
+	}
+	for _, test := range tests {
+		e, err := event.New(context.Background(), "service1", event.AccessLogKind, test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decodeAccessLog(e); (err == nil) != test.valid {
+			t.Errorf("%s: decodeAccessLog got error %v want valid %v", test.name, err, test.valid)
+		}
+	}
+
+	e, _ := event.New(context.Background(), "service1", event.Kind{Type: "AccessLog", SchemaVersion: 2}, valid)
+	if _, err := decodeAccessLog(e); err == nil {
+		t.Errorf("decodeAccessLog got no error for an unknown schema version")
+	}
+}
+
+func TestDeadLetterMessage(t *testing.T) {
+	msg := kafka.Message{
+		Topic:     "service1_logs",
+		Partition: 2,
+		Offset:    42,
+		Key:       []byte("key"),
+		Value:     []byte("not json"),
+		Headers:   []kafka.Header{{Key: "content-type", Value: []byte("text/plain")}},
+	}
+	got := deadLetterMessage(msg, errors.New("bad message"))
+
+	if string(got.Key) != "key" || string(got.Value) != "not json" || got.Topic != "" {
+		t.Errorf("deadLetterMessage got key %q value %q topic %q", got.Key, got.Value, got.Topic)
+	}
+	headers := make(map[string]string)
+	for _, h := range got.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	want := map[string]string{
+		"content-type":            "text/plain",
+		headerDeadLetterError:     "bad message",
+		headerDeadLetterTopic:     "service1_logs",
+		headerDeadLetterPartition: "2",
+		headerDeadLetterOffset:    "42",
+	}
+	for key, value := range want {
+		if headers[key] != value {
+			t.Errorf("deadLetterMessage header %s got %q want %q", key, headers[key], value)
+		}
+	}
+}
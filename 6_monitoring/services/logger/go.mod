@@ -2,9 +2,26 @@ module service3
 
 go 1.20
 
-require github.com/segmentio/kafka-go v0.4.40
+require (
+	common v0.0.0
+	github.com/lib/pq v1.10.9
+	github.com/prometheus/client_golang v1.15.1
+	github.com/segmentio/kafka-go v0.4.40
+)
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
 	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.42.0 // indirect
+	github.com/prometheus/procfs v0.9.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
 )
+
+replace common => ../common
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// lagInterval is how often the consumer lag of a worker's partitions is read
+// from the brokers.
+const lagInterval = 10 * time.Second
+
+// lagTracker keeps the next offset of each partition a worker consumes and
+// reports the consumer lag against the partition's high watermark. The reader
+// statistics only cover the partition fetched last, and stop changing when
+// the worker is stuck on a message, so the high watermarks are also read from
+// the brokers every lagInterval, letting the lag grow while nothing is
+// committed.
+type lagTracker struct {
+	topic  string
+	client *kafka.Client
+
+	mu   sync.Mutex
+	next map[int]int64
+}
+
+func newLagTracker(brokers []string, topic string) *lagTracker {
+	return &lagTracker{
+		topic:  topic,
+		client: &kafka.Client{Addr: kafka.TCP(brokers...), Timeout: lagInterval / 2},
+		next:   make(map[int]int64),
+	}
+}
+
+// fetched records the first offset read from a partition, before anything of
+// it was committed.
+func (l *lagTracker) fetched(msg kafka.Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.next[msg.Partition]; !ok {
+		l.next[msg.Partition] = msg.Offset
+	}
+}
+
+// committed records the commit of msg and updates the lag from the high
+// watermark msg was fetched with.
+func (l *lagTracker) committed(msg kafka.Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next[msg.Partition] = msg.Offset + 1
+	l.set(msg.Partition, msg.HighWaterMark)
+}
+
+// set updates the lag of partition. l.mu must be held.
+func (l *lagTracker) set(partition int, highWaterMark int64) {
+	lag := highWaterMark - l.next[partition]
+	if lag < 0 {
+		lag = 0
+	}
+	consumerLag.WithLabelValues(l.topic, strconv.Itoa(partition)).Set(float64(lag))
+}
+
+// run updates the lag from the brokers every lagInterval until ctx is done.
+func (l *lagTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.update(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("[%s] Failed to read the consumer lag: %s", l.topic, err)
+			}
+		}
+	}
+}
+
+func (l *lagTracker) update(ctx context.Context) error {
+	l.mu.Lock()
+	var requests []kafka.OffsetRequest
+	for partition := range l.next {
+		requests = append(requests, kafka.LastOffsetOf(partition))
+	}
+	l.mu.Unlock()
+	if len(requests) == 0 {
+		return nil
+	}
+
+	resp, err := l.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{l.topic: requests},
+	})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, p := range resp.Topics[l.topic] {
+		if p.Error != nil {
+			err = p.Error
+			continue
+		}
+		l.set(p.Partition, p.LastOffset)
+	}
+	return err
+}
+
+// clear removes the lag of the worker's partitions, which the group may move
+// to another replica once the worker stops.
+func (l *lagTracker) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for partition := range l.next {
+		consumerLag.DeleteLabelValues(l.topic, strconv.Itoa(partition))
+	}
+}
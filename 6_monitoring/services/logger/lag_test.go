@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestLagTracker(t *testing.T) {
+	l := newLagTracker(nil, "service1_logs")
+	l.fetched(kafka.Message{Partition: 2, Offset: 5})
+	if got := l.next[2]; got != 5 {
+		t.Errorf("next offset after the first fetch got %d want 5", got)
+	}
+
+	l.committed(kafka.Message{Partition: 2, Offset: 5, HighWaterMark: 10})
+	l.fetched(kafka.Message{Partition: 2, Offset: 6})
+	if got := testutil.ToFloat64(consumerLag.WithLabelValues("service1_logs", "2")); got != 4 {
+		t.Errorf("lag after the commit got %g want 4", got)
+	}
+
+	// A newer high watermark read while the worker is stuck.
+	l.mu.Lock()
+	l.set(2, 50)
+	l.mu.Unlock()
+	if got := testutil.ToFloat64(consumerLag.WithLabelValues("service1_logs", "2")); got != 44 {
+		t.Errorf("lag while stuck got %g want 44", got)
+	}
+
+	l.clear()
+	if n := testutil.CollectAndCount(consumerLag); n != 0 {
+		t.Errorf("got %d lag series after clear want 0", n)
+	}
+}
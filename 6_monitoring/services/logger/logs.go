@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"common/pagination"
+)
+
+// getLogs handles GET /logs. It supports the service, method, path (prefix),
+// since and until (RFC 3339) filters and the shared pagination parameters;
+// records are sorted by time, newest first unless sort=time is given.
+func getLogs(store Store, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("sort") == "" {
+		query.Set("sort", "-time")
+	}
+	params, err := pagination.ParseParams(query, "time")
+	if err == nil && params.Sort.Field != "time" {
+		err = pagination.ErrInvalidSort
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid pagination parameters: %s", err.Error())
+		return
+	}
+
+	q := Query{
+		Service: query.Get("service"),
+		Method:  strings.ToUpper(query.Get("method")),
+		Path:    query.Get("path"),
+		Params:  params,
+	}
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := query.Get(bound.name); s != "" {
+			*bound.value, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Invalid %s value, expected an RFC 3339 time.", bound.name)
+				return
+			}
+		}
+	}
+
+	records, err := store.Query(r.Context(), q)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to query logs: %s", err.Error())
+		return
+	}
+
+	page := pagination.New(records, params, func(rec Record) (string, int) {
+		return rec.Time.UTC().Format(time.RFC3339Nano), int(rec.ID)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
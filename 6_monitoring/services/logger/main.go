@@ -2,36 +2,81 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
+
+	"common/envconfig"
+	"common/event"
+	"common/kafkaconfig"
 )
 
 func main() {
 	brokers := []string{os.Getenv("KAFKA_HOST")} // Modify with your Kafka broker addresses
 
-	// Configure Kafka reader for Topic 1
-	topic1 := os.Getenv("KAFKA_TOPIC_1")
-	topic1Reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   brokers,
-		Topic:     topic1,
-		Partition: 0, // Adjust the partition as needed
-		MinBytes:  10e3,
-		MaxBytes:  10e6,
-	})
+	// All logger replicas join the same consumer group, so the partitions of
+	// each topic are split between them.
+	groupID := os.Getenv("KAFKA_GROUP_ID")
+	if groupID == "" {
+		groupID = "logger"
+	}
 
-	// Configure Kafka reader for Topic 2
-	topic2 := os.Getenv("KAFKA_TOPIC_2")
-	topic2Reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   brokers,
-		Topic:     topic2,
-		Partition: 0, // Adjust the partition as needed
-		MinBytes:  10e3,
-		MaxBytes:  10e6,
-	})
+	// Topics are either listed in KAFKA_TOPICS or subscribed to by the
+	// KAFKA_TOPIC_PATTERN regular expression, in which case topics created
+	// later are picked up every KAFKA_TOPIC_REFRESH_INTERVAL.
+	topics := parseTopics(os.Getenv("KAFKA_TOPICS"))
+	if len(topics) == 0 {
+		// Configuration of older deployments
+		topics = parseTopics(os.Getenv("KAFKA_TOPIC_1") + "," + os.Getenv("KAFKA_TOPIC_2"))
+	}
+	var pattern *regexp.Regexp
+	if patternStr := os.Getenv("KAFKA_TOPIC_PATTERN"); patternStr != "" {
+		var err error
+		pattern, err = regexp.Compile(patternStr)
+		if err != nil {
+			log.Fatal("Invalid KAFKA_TOPIC_PATTERN value:", err)
+		}
+	}
+	if len(topics) == 0 && pattern == nil {
+		log.Fatal("No topics configured, set KAFKA_TOPICS or KAFKA_TOPIC_PATTERN")
+	}
+	// Malformed messages are sent to KAFKA_DLQ_TOPIC, or only logged and
+	// counted if it is not set.
+	deadLetterTopic := os.Getenv("KAFKA_DLQ_TOPIC")
+	if deadLetterTopic != "" && (containsTopic(topics, deadLetterTopic) || pattern != nil && pattern.MatchString(deadLetterTopic)) {
+		log.Fatal("KAFKA_DLQ_TOPIC must not be one of the consumed topics")
+	}
+	shutdownTimeout, err := envconfig.Duration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	retention, err := envconfig.Duration("LOG_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	refreshInterval, err := envconfig.Duration("KAFKA_TOPIC_REFRESH_INTERVAL", time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The request metrics count up to LOG_MAX_ROUTES routes per service.
+	maxRoutes, err := envconfig.Int("LOG_MAX_ROUTES", defaultMaxRoutes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	routes = newRouteLimiter(maxRoutes)
 
 	// Initialize context and signal channel for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -45,37 +90,170 @@ func main() {
 		cancel()
 	}()
 
-	// Start a goroutine to read from Topic 1
-	go func() {
-		defer topic1Reader.Close()
+	// Initialize log storage
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go runRetention(ctx, store, retention, time.Hour)
+
+	var deadLetters publisher
+	var deadLetterWriter *kafka.Writer
+	if deadLetterTopic != "" {
+		deadLetterWriter = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  brokers,
+			Topic:    deadLetterTopic,
+			Balancer: &kafka.LeastBytes{},
+		})
+		deadLetters = deadLetterWriter
+	}
 
-		for {
-			msg, err := topic1Reader.ReadMessage(ctx)
-			if err != nil {
-				log.Println("Error reading message from Topic 1:", err)
-				continue
-			}
+	// Check the listed and dead-letter topics in the background, /ready fails
+	// while one of them is missing. Topics matching KAFKA_TOPIC_PATTERN are
+	// consumed once they exist and not checked.
+	topicConfig, err := kafkaconfig.TopicConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	checkedTopics := append([]string(nil), topics...)
+	if deadLetterTopic != "" {
+		checkedTopics = append(checkedTopics, deadLetterTopic)
+	}
+	topicCheck := kafkaconfig.NewTopicCheck(brokers, checkedTopics, topicConfig)
+	go topicCheck.Run(ctx, 30*time.Second)
 
-			log.Printf("[Topic 1] Received message: %s\n", string(msg.Value))
+	tail := newHub()
+	sup := newSupervisor(brokers, groupID, store, tail, deadLetters)
+
+	// Initialize HTTP routes
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := topicCheck.Err(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Not ready: %s", err.Error())
+			return
+		}
+		fmt.Fprintf(w, "Ready.")
+	})
+	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getLogs(store, w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "Unsupported request method.")
+		}
+	})
+	http.HandleFunc("/logs/stream", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			streamLogs(tail, w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "Unsupported request method.")
+		}
+	})
+	// Requests share ctx, so that open streams end on shutdown.
+	server := &http.Server{Addr: ":8080", BaseContext: func(net.Listener) context.Context { return ctx }}
+	go func() {
+		log.Println("Server listening on :8080")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			sup.fail(fmt.Errorf("HTTP server: %w", err))
 		}
 	}()
 
-	// Start a goroutine to read from Topic 2
-	go func() {
-		defer topic2Reader.Close()
+	// Start one worker per topic
+	for _, topic := range topics {
+		sup.start(ctx, topic)
+	}
+	if pattern != nil {
+		sup.watch(ctx, pattern, refreshInterval)
+	}
 
-		for {
-			msg, err := topic2Reader.ReadMessage(ctx)
-			if err != nil {
-				log.Println("Error reading message from Topic 2:", err)
-				continue
-			}
+	// Wait for the termination signal or a fatal error
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+	case err := <-sup.fatal:
+		log.Println("Fatal error:", err)
+		exitCode = 1
+	}
+	cancel()
 
-			log.Printf("[Topic 2] Received message: %s\n", string(msg.Value))
-		}
-	}()
+	// Let the workers commit their last message and close their readers
+	shutdownCtx, stop := context.WithTimeout(context.Background(), shutdownTimeout)
+	server.Shutdown(shutdownCtx)
+	if err := sup.wait(shutdownCtx); err != nil {
+		log.Println("Workers did not stop within", shutdownTimeout)
+		exitCode = 1
+	}
+	stop()
 
-	// Wait for the termination signal
-	<-ctx.Done()
+	if deadLetterWriter != nil {
+		deadLetterWriter.Close()
+	}
+	store.Close()
 	log.Println("Service stopped.")
+	os.Exit(exitCode)
+}
+
+// openStore opens the Postgres store when DB_HOST is set and the file store
+// in LOG_STORE_DIR otherwise.
+func openStore() (Store, error) {
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		dir := os.Getenv("LOG_STORE_DIR")
+		if dir == "" {
+			dir = "logs"
+		}
+		log.Println("Storing logs in", dir)
+		return newFileStore(dir)
+	}
+
+	port, err := strconv.Atoi(os.Getenv("DB_PORT"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_PORT value: %w", err)
+	}
+	dbInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		host, port, os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+	db, err := sql.Open("postgres", dbInfo)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Storing logs in Postgres")
+	return newPostgresStore(db), nil
+}
+
+// parseTopics splits a comma-separated list of topics, skipping empty and
+// duplicate entries.
+func parseTopics(s string) []string {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, topic := range strings.Split(s, ",") {
+		topic = strings.TrimSpace(topic)
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+func containsTopic(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// describe formats a message for the log. Messages that are not event
+// envelopes are printed as they are.
+func describe(msg kafka.Message) string {
+	e, err := event.Decode(msg)
+	if err != nil {
+		return fmt.Sprintf("%s (%s)", string(msg.Value), err.Error())
+	}
+	return fmt.Sprintf("%s v%d from %s, id %s, trace %s: %s", e.Type, e.SchemaVersion, e.Source, e.ID, e.TraceID, string(e.Data))
 }
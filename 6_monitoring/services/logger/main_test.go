@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestParseTopics(t *testing.T) {
+	got := parseTopics(" service1_logs,,service2_logs, service1_logs ")
+	want := []string{"service1_logs", "service2_logs"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTopics got %v want %v", got, want)
+	}
+
+	if got := parseTopics(","); got != nil {
+		t.Errorf("parseTopics got %v want no topics", got)
+	}
+}
+
+func TestMatchTopics(t *testing.T) {
+	pattern := regexp.MustCompile(`^service\d+_logs$`)
+	got := matchTopics(pattern, []string{"service2_logs", "__consumer_offsets", "service1_events", "service1_logs"})
+	want := []string{"service1_logs", "service2_logs"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("matchTopics got %v want %v", got, want)
+	}
+}
+
+func TestListTopicsTriesEachBroker(t *testing.T) {
+	// Brokers that accept the connection and hang up.
+	var brokers []string
+	dialed := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		brokers = append(brokers, l.Addr().String())
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				dialed <- l.Addr().String()
+				conn.Close()
+			}
+		}()
+	}
+
+	if _, err := listTopics(context.Background(), brokers); err == nil {
+		t.Error("listTopics got no error")
+	}
+	got := map[string]bool{<-dialed: true, <-dialed: true}
+	if !got[brokers[0]] || !got[brokers[1]] {
+		t.Errorf("listTopics dialed %v want both brokers %v", got, brokers)
+	}
+
+	if _, err := listTopics(context.Background(), nil); err == nil {
+		t.Error("listTopics got no error without brokers")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("fetching message: %w", kafka.LeaderNotAvailable), true},
+		{kafka.GroupAuthorizationFailed, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{errors.New("unexpected"), false},
+	}
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.want {
+			t.Errorf("isTransient(%v) got %v want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// fakePublisher collects the messages written to it.
+type fakePublisher struct {
+	msgs []kafka.Message
+}
+
+func (p *fakePublisher) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func TestSkipsMessageThatKeepsCrashing(t *testing.T) {
+	msg := kafka.Message{Topic: "service1_logs", Partition: 1, Offset: 5}
+	next := kafka.Message{Topic: "service1_logs", Partition: 1, Offset: 6}
+
+	var crashed crashes
+	for i := 1; i <= maxCrashes; i++ {
+		if got := crashed.record(panicError{value: "boom", msg: &msg}); got != (i == maxCrashes) {
+			t.Errorf("crash %d: record got %v", i, got)
+		}
+	}
+	if !crashed.poison(msg) || crashed.poison(next) {
+		t.Errorf("poison got %v for the crashing message and %v for the next one", crashed.poison(msg), crashed.poison(next))
+	}
+
+	deadLetters := &fakePublisher{}
+	s := newSupervisor(nil, "logger", nil, nil, deadLetters)
+	if !s.skip(context.Background(), msg, crashed.last) {
+		t.Fatal("skip got false")
+	}
+	if len(deadLetters.msgs) != 1 {
+		t.Fatalf("got %d dead letters want 1", len(deadLetters.msgs))
+	}
+
+	crashed.record(panicError{value: "boom", msg: &next})
+	if crashed.poison(msg) || crashed.poison(next) {
+		t.Error("a crash on another message did not start counting again")
+	}
+}
@@ -0,0 +1,19 @@
+-- Daily partitions are created by the logger as records arrive and dropped
+-- once they are older than LOG_RETENTION.
+CREATE TABLE access_logs (
+  id              BIGSERIAL,
+  time            TIMESTAMPTZ NOT NULL,
+  service         TEXT NOT NULL,
+  event_id        TEXT NOT NULL,
+  method          TEXT NOT NULL,
+  path            TEXT NOT NULL,
+  ip              TEXT NOT NULL,
+  trace_id        TEXT NOT NULL DEFAULT '',
+  topic           TEXT NOT NULL,
+  kafka_partition INTEGER NOT NULL,
+  kafka_offset    BIGINT NOT NULL,
+  PRIMARY KEY (time, service, event_id)
+) PARTITION BY RANGE (time);
+
+CREATE INDEX access_logs_time_id_idx ON access_logs (time, id);
+CREATE INDEX access_logs_service_time_idx ON access_logs (service, time);
@@ -0,0 +1,7 @@
+ALTER TABLE access_logs
+  DROP COLUMN status,
+  DROP COLUMN bytes,
+  DROP COLUMN duration,
+  DROP COLUMN user_agent,
+  DROP COLUMN request_id,
+  DROP COLUMN pod;
@@ -0,0 +1,8 @@
+-- Records of older services have none of these, so they default to empty.
+ALTER TABLE access_logs
+  ADD COLUMN status     INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN bytes      BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN duration   DOUBLE PRECISION NOT NULL DEFAULT 0,
+  ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+  ADD COLUMN request_id TEXT NOT NULL DEFAULT '',
+  ADD COLUMN pod        TEXT NOT NULL DEFAULT '';
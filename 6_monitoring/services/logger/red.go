@@ -0,0 +1,115 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"common/event"
+)
+
+// Rate, errors and duration of the requests served by all services, derived
+// from their access logs.
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logger_http_requests_total",
+		Help: "Number of HTTP requests served per service, route, method and status, from the access logs",
+	}, []string{"service", "route", "method", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "logger_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests per service, route, method and status, from the access logs that have it",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "route", "method", "status"})
+)
+
+// idSegment matches a path segment holding an ID, optionally followed by a
+// custom method such as :restore.
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F-]{27})(:[A-Za-z]+)?$`)
+
+// defaultMaxRoutes is the number of routes counted per service unless
+// LOG_MAX_ROUTES says otherwise.
+const defaultMaxRoutes = 50
+
+// routes bounds the route label of the request metrics.
+var routes = newRouteLimiter(defaultMaxRoutes)
+
+// routeLimiter bounds the number of routes counted per service. The first
+// routes seen of a service get their own series and any later ones are
+// counted as otherRoute, so that scanners and typos cannot create series
+// without end, whatever routes the services serve.
+type routeLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	routes map[string]map[string]bool
+}
+
+func newRouteLimiter(max int) *routeLimiter {
+	return &routeLimiter{max: max, routes: make(map[string]map[string]bool)}
+}
+
+// route returns the normalized route of path, or otherRoute if service has
+// used up its routes.
+func (l *routeLimiter) route(service, path string) string {
+	route := normalizeRoute(path)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := l.routes[service]
+	if seen == nil {
+		seen = make(map[string]bool)
+		l.routes[service] = seen
+	}
+	if !seen[route] {
+		if len(seen) >= l.max {
+			return otherRoute
+		}
+		seen[route] = true
+	}
+	return route
+}
+
+const otherRoute = "other"
+
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "CONNECT": true, "OPTIONS": true, "TRACE": true,
+}
+
+// observeRequest counts a request from the access log of service.
+func observeRequest(service string, data event.AccessLog) {
+	method := data.Method
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	status := "unknown"
+	if data.Status != 0 {
+		status = strconv.Itoa(data.Status)
+	}
+	labels := prometheus.Labels{
+		"service": service,
+		"route":   routes.route(service, data.Path),
+		"method":  method,
+		"status":  status,
+	}
+
+	requestsTotal.With(labels).Inc()
+	if data.Duration > 0 {
+		requestDuration.With(labels).Observe(data.Duration)
+	}
+}
+
+// normalizeRoute replaces the IDs in path with {id}, e.g. /users/42:restore
+// becomes /users/{id}:restore.
+func normalizeRoute(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = idSegment.ReplaceAllString(segment, "{id}$2")
+	}
+	return "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestNormalizeRoute(t *testing.T) {
+	tests := map[string]string{
+		"/users":                  "/users",
+		"/users/":                 "/users",
+		"/users/42":               "/users/{id}",
+		"/users/42:restore":       "/users/{id}:restore",
+		"/users/42/orders/latest": "/users/{id}/orders/latest",
+		"/users/product/7":        "/users/product/{id}",
+		"/products/0b6f1f1e-5c1a-4b1e-9d2a-3f4e5a6b7c8d": "/products/{id}",
+		"/":             "/",
+		"/wp-login.php": "/wp-login.php",
+	}
+	for path, want := range tests {
+		if got := normalizeRoute(path); got != want {
+			t.Errorf("normalizeRoute(%q) got %q want %q", path, got, want)
+		}
+	}
+}
+
+func TestRouteLimiter(t *testing.T) {
+	l := newRouteLimiter(2)
+	for _, tt := range []struct{ path, want string }{
+		{"/users/1", "/users/{id}"},
+		{"/users", "/users"},
+		{"/users/2", "/users/{id}"},
+		{"/wp-login.php", otherRoute},
+	} {
+		if got := l.route("service1", tt.path); got != tt.want {
+			t.Errorf("route(%q) got %q want %q", tt.path, got, tt.want)
+		}
+	}
+	if got := l.route("service2", "/products"); got != "/products" {
+		t.Errorf("routes of service1 limited service2, got %q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"common/event"
+	"common/pagination"
+)
+
+// Record is a stored access log entry.
+type Record struct {
+	// ID orders records with the same time; it is not unique across days.
+	ID        int64     `json:"-"`
+	Time      time.Time `json:"time"`
+	Service   string    `json:"service"`
+	EventID   string    `json:"event_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	IP        string    `json:"ip"`
+	Status    int       `json:"status,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Duration  float64   `json:"duration,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+}
+
+// Query selects records for GET /logs. Zero values do not filter. Path
+// matches as a prefix; Since is inclusive and Until exclusive.
+type Query struct {
+	Service string
+	Method  string
+	Path    string
+	Since   time.Time
+	Until   time.Time
+	Params  pagination.Params
+}
+
+// Store keeps access log records partitioned by day.
+type Store interface {
+	// Insert stores a record and reports whether it is new. Storing a
+	// record again must not fail.
+	Insert(ctx context.Context, rec Record) (bool, error)
+	// Query returns up to q.Params.FetchLimit() records in the order of
+	// q.Params.Sort, which is by time.
+	Query(ctx context.Context, q Query) ([]Record, error)
+	// Purge removes the days that ended before cutoff.
+	Purge(ctx context.Context, cutoff time.Time) error
+	Close() error
+}
+
+// newRecord builds a record from an access log event.
+func newRecord(e event.Envelope, data event.AccessLog, topic string, partition int, offset int64) Record {
+	return Record{
+		Time:      e.Time,
+		Service:   e.Source,
+		EventID:   e.ID,
+		Method:    data.Method,
+		Path:      data.Path,
+		IP:        data.IP,
+		Status:    data.Status,
+		Bytes:     data.Bytes,
+		Duration:  data.Duration,
+		UserAgent: data.UserAgent,
+		RequestID: data.RequestID,
+		Pod:       data.Pod,
+		TraceID:   e.TraceID,
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+	}
+}
+
+// runRetention purges records older than retention every interval until ctx
+// is done.
+func runRetention(ctx context.Context, store Store, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := store.Purge(ctx, time.Now().Add(-retention)); err != nil && ctx.Err() == nil {
+			log.Println("Failed to purge old logs:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// day returns the start of the UTC day of t.
+func day(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
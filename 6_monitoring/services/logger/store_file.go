@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStore keeps records in one JSON lines file per day. It is meant for
+// local runs without Postgres: queries scan whole files and records that
+// Kafka redelivers are stored, and counted in the request metrics, twice.
+type fileStore struct {
+	dir string
+
+	mu    sync.Mutex
+	lines map[string]int64 // lines per file, loaded on first write
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir, lines: make(map[string]int64)}, nil
+}
+
+func (s *fileStore) path(d time.Time) string {
+	return filepath.Join(s.dir, "access-"+d.Format("2006-01-02")+".jsonl")
+}
+
+func (s *fileStore) Insert(ctx context.Context, rec Record) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path(day(rec.Time))
+	n, ok := s.lines[path]
+	if !ok {
+		if err := truncateTornLine(path); err != nil {
+			return false, err
+		}
+		records, err := readRecords(path)
+		if err != nil {
+			return false, err
+		}
+		n = int64(len(records))
+	}
+
+	rec.ID = n + 1
+	line, err := json.Marshal(fileRecord{ID: rec.ID, Record: rec})
+	if err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	s.lines[path] = rec.ID
+	return true, nil
+}
+
+func (s *fileStore) Query(ctx context.Context, q Query) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	days, err := s.days()
+	if err != nil {
+		return nil, err
+	}
+	desc := q.Params.Sort.Desc
+	if desc {
+		sort.Slice(days, func(i, j int) bool { return days[i].After(days[j]) })
+	}
+
+	var cursorTime time.Time
+	if q.Params.Cursor != nil {
+		cursorTime, _ = time.Parse(time.RFC3339Nano, q.Params.Cursor.Value)
+	}
+
+	limit := q.Params.FetchLimit()
+	var matched []Record
+	for _, d := range days {
+		// Files hold one day each, so whole files can be skipped.
+		if (!q.Since.IsZero() && !d.AddDate(0, 0, 1).After(q.Since)) || (!q.Until.IsZero() && !d.Before(q.Until)) {
+			continue
+		}
+
+		records, err := readRecords(s.path(d))
+		if err != nil {
+			return nil, err
+		}
+		var dayMatched []Record
+		for _, rec := range records {
+			if !q.matches(rec) {
+				continue
+			}
+			if q.Params.Cursor != nil && !after(rec, cursorTime, int64(q.Params.Cursor.ID), desc) {
+				continue
+			}
+			dayMatched = append(dayMatched, rec)
+		}
+		sort.Slice(dayMatched, func(i, j int) bool {
+			return after(dayMatched[j], dayMatched[i].Time, dayMatched[i].ID, desc)
+		})
+		matched = append(matched, dayMatched...)
+		if len(matched) >= limit {
+			return matched[:limit], nil
+		}
+	}
+	return matched, nil
+}
+
+// Purge removes the files of the days that ended before cutoff.
+func (s *fileStore) Purge(ctx context.Context, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	for _, d := range days {
+		if d.AddDate(0, 0, 1).After(cutoff) {
+			continue
+		}
+		path := s.path(d)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.lines, path)
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// days returns the days with a file in ascending order.
+func (s *fileStore) days() ([]time.Time, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, entry := range entries {
+		name := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "access-"), ".jsonl")
+		if d, err := time.Parse("2006-01-02", name); err == nil {
+			days = append(days, d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// fileRecord is the on-disk form of a record, which keeps the ID.
+type fileRecord struct {
+	ID int64 `json:"id"`
+	Record
+}
+
+// truncateTornLine cuts off a last line torn by a crash during a write, so
+// that the next record starts on a line of its own.
+func truncateTornLine(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	return os.Truncate(path, int64(bytes.LastIndexByte(data, '\n')+1))
+}
+
+func readRecords(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Skip a line torn by a crash during a write.
+			continue
+		}
+		rec.Record.ID = rec.ID
+		records = append(records, rec.Record)
+	}
+	return records, scanner.Err()
+}
+
+// matches applies the filters of q, except for the cursor.
+func (q Query) matches(rec Record) bool {
+	return (q.Service == "" || rec.Service == q.Service) &&
+		(q.Method == "" || rec.Method == q.Method) &&
+		strings.HasPrefix(rec.Path, q.Path) &&
+		(q.Since.IsZero() || !rec.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || rec.Time.Before(q.Until))
+}
+
+// after reports whether rec comes after the position (t, id) in the given
+// sort direction.
+func after(rec Record, t time.Time, id int64, desc bool) bool {
+	if !rec.Time.Equal(t) {
+		return rec.Time.After(t) != desc
+	}
+	if rec.ID == id {
+		return false
+	}
+	return (rec.ID > id) != desc
+}
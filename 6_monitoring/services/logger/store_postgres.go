@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// partitionPrefix names the daily partitions of access_logs, e.g.
+// access_logs_20230608.
+const partitionPrefix = "access_logs_"
+
+// postgresStore keeps records in the access_logs table, which is range
+// partitioned by day so that retention drops whole partitions.
+type postgresStore struct {
+	db *sql.DB
+
+	mu         sync.Mutex
+	partitions map[time.Time]bool
+}
+
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{db: db, partitions: make(map[time.Time]bool)}
+}
+
+func (s *postgresStore) Insert(ctx context.Context, rec Record) (bool, error) {
+	d := day(rec.Time)
+	if err := s.ensurePartition(ctx, d); err != nil {
+		return false, err
+	}
+	inserted, err := s.insert(ctx, rec)
+	// Another replica may have dropped the partition since it was cached.
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23514" {
+		s.mu.Lock()
+		delete(s.partitions, d)
+		s.mu.Unlock()
+		if err := s.ensurePartition(ctx, d); err != nil {
+			return false, err
+		}
+		inserted, err = s.insert(ctx, rec)
+	}
+	return inserted, err
+}
+
+func (s *postgresStore) insert(ctx context.Context, rec Record) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `INSERT INTO access_logs
+		(time, service, event_id, method, path, ip, status, bytes, duration, user_agent, request_id, pod,
+		 trace_id, topic, kafka_partition, kafka_offset)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		ON CONFLICT DO NOTHING`,
+		rec.Time, rec.Service, rec.EventID, rec.Method, rec.Path, rec.IP, rec.Status, rec.Bytes, rec.Duration, rec.UserAgent, rec.RequestID, rec.Pod,
+		rec.TraceID, rec.Topic, rec.Partition, rec.Offset)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// ensurePartition creates the partition for the day starting at d.
+func (s *postgresStore) ensurePartition(ctx context.Context, d time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.partitions[d] {
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s PARTITION OF access_logs FOR VALUES FROM ('%s') TO ('%s')",
+		partitionPrefix+d.Format("20060102"), d.Format(time.RFC3339), d.AddDate(0, 0, 1).Format(time.RFC3339)))
+	// Another replica may have created the partition concurrently.
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P07" {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	s.partitions[d] = true
+	return nil
+}
+
+func (s *postgresStore) Query(ctx context.Context, q Query) ([]Record, error) {
+	var conds []string
+	var args []interface{}
+	if q.Service != "" {
+		args = append(args, q.Service)
+		conds = append(conds, fmt.Sprintf("service = $%d", len(args)))
+	}
+	if q.Method != "" {
+		args = append(args, q.Method)
+		conds = append(conds, fmt.Sprintf("method = $%d", len(args)))
+	}
+	if q.Path != "" {
+		args = append(args, likePrefix(q.Path))
+		conds = append(conds, fmt.Sprintf("path LIKE $%d", len(args)))
+	}
+	if !q.Since.IsZero() {
+		args = append(args, q.Since)
+		conds = append(conds, fmt.Sprintf("time >= $%d", len(args)))
+	}
+	if !q.Until.IsZero() {
+		args = append(args, q.Until)
+		conds = append(conds, fmt.Sprintf("time < $%d", len(args)))
+	}
+	if cond, keysetArgs := q.Params.Keyset(len(args) + 1); cond != "" {
+		args = append(args, keysetArgs...)
+		conds = append(conds, cond)
+	}
+
+	sqlQuery := `SELECT id, time, service, event_id, method, path, ip, status, bytes, duration, user_agent, request_id, pod,
+		trace_id, topic, kafka_partition, kafka_offset FROM access_logs`
+	if len(conds) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, q.Params.FetchLimit())
+	sqlQuery += fmt.Sprintf(" ORDER BY %s LIMIT $%d", q.Params.OrderBy(), len(args))
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var rec Record
+		err := rows.Scan(&rec.ID, &rec.Time, &rec.Service, &rec.EventID, &rec.Method, &rec.Path, &rec.IP,
+			&rec.Status, &rec.Bytes, &rec.Duration, &rec.UserAgent, &rec.RequestID, &rec.Pod,
+			&rec.TraceID, &rec.Topic, &rec.Partition, &rec.Offset)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// Purge drops the partitions of the days that ended before cutoff.
+func (s *postgresStore) Purge(ctx context.Context, cutoff time.Time) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'access_logs'`)
+	if err != nil {
+		return err
+	}
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		d, err := time.Parse("20060102", strings.TrimPrefix(name, partitionPrefix))
+		if err == nil && !d.AddDate(0, 0, 1).After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range expired {
+		if _, err := s.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+pq.QuoteIdentifier(name)); err != nil {
+			return err
+		}
+		d, _ := time.Parse("20060102", strings.TrimPrefix(name, partitionPrefix))
+		s.mu.Lock()
+		delete(s.partitions, d)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+func likePrefix(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return r.Replace(s) + "%"
+}
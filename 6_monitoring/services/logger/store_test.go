@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"common/pagination"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2023, 6, 8, 23, 59, 58, 0, time.UTC)
+	for i, path := range []string{"/users/1", "/products/1", "/users/2", "/users/3"} {
+		rec := Record{Time: start.Add(time.Duration(i) * time.Second), Service: "service1", Method: "GET", Path: path}
+		if _, err := store.Insert(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	params, err := pagination.ParseParams(url.Values{"limit": {"2"}, "sort": {"-time"}}, "time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := Query{Path: "/users/", Params: params}
+	records, err := store.Query(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := pagination.New(records, params, func(rec Record) (string, int) {
+		return rec.Time.UTC().Format(time.RFC3339Nano), int(rec.ID)
+	})
+	if len(page.Items) != 2 || page.Items[0].Path != "/users/3" || page.Items[1].Path != "/users/2" || page.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+
+	q.Params, err = pagination.ParseParams(url.Values{"limit": {"2"}, "sort": {"-time"}, "cursor": {page.NextCursor}}, "time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = store.Query(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Path != "/users/1" {
+		t.Fatalf("unexpected second page: %+v", records)
+	}
+
+	// The first two records fall on June 8, the others on June 9.
+	if err := store.Purge(ctx, time.Date(2023, 6, 9, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	q.Params = params
+	q.Path = ""
+	records, err = store.Query(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Path != "/users/2" {
+		t.Errorf("unexpected records after purge: %+v", records)
+	}
+}
+
+func TestFileStoreAppendsAfterTornLine(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{Time: time.Date(2023, 6, 8, 12, 0, 0, 0, time.UTC), Service: "service1", Method: "GET", Path: "/users/1"}
+	if _, err := store.Insert(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of the next write, then a restart.
+	f, err := os.OpenFile(store.path(day(rec.Time)), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":2,"time":"2023-06`)
+	f.Close()
+	if store, err = newFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.Path = "/users/2"
+	if _, err := store.Insert(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	records, err := readRecords(store.path(day(rec.Time)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Path != "/users/2" || records[1].ID != 2 {
+		t.Errorf("unexpected records after the torn write: %+v", records)
+	}
+}
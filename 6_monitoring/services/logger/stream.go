@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// subscriberBuffer is the number of records a subscriber may fall
+	// behind before it is dropped.
+	subscriberBuffer = 256
+	maxSubscribers   = 100
+	keepAliveEvery   = 15 * time.Second
+	// writeTimeout bounds writing one event, so that a client that stops
+	// reading cannot hold the handler forever.
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	streamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "logger_stream_subscribers",
+		Help: "Number of clients connected to GET /logs/stream",
+	})
+
+	streamDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "logger_stream_dropped_subscribers_total",
+		Help: "Number of GET /logs/stream clients dropped for reading too slowly",
+	})
+)
+
+// streamFilter selects the records sent to a subscriber. Zero values do not
+// filter.
+type streamFilter struct {
+	Service     string
+	Method      string
+	PathPrefix  string
+	StatusClass int // 2 for 2xx and so on
+}
+
+func (f streamFilter) matches(rec Record) bool {
+	return (f.Service == "" || rec.Service == f.Service) &&
+		(f.Method == "" || rec.Method == f.Method) &&
+		strings.HasPrefix(rec.Path, f.PathPrefix) &&
+		(f.StatusClass == 0 || rec.Status/100 == f.StatusClass)
+}
+
+type subscriber struct {
+	filter  streamFilter
+	records chan Record
+	// dropped is closed when the subscriber could not keep up.
+	dropped chan struct{}
+}
+
+// hub fans records out to the live tail subscribers. Publishing never
+// blocks: a subscriber whose buffer is full is dropped.
+type hub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]bool
+}
+
+func newHub() *hub {
+	return &hub{subs: make(map[*subscriber]bool)}
+}
+
+// subscribe registers a subscriber, or returns nil if there are too many.
+func (h *hub) subscribe(filter streamFilter) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) >= maxSubscribers {
+		return nil
+	}
+	sub := &subscriber{
+		filter:  filter,
+		records: make(chan Record, subscriberBuffer),
+		dropped: make(chan struct{}),
+	}
+	h.subs[sub] = true
+	streamSubscribers.Inc()
+	return sub
+}
+
+func (h *hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		streamSubscribers.Dec()
+	}
+}
+
+func (h *hub) publish(rec Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !sub.filter.matches(rec) {
+			continue
+		}
+		select {
+		case sub.records <- rec:
+		default:
+			delete(h.subs, sub)
+			close(sub.dropped)
+			streamSubscribers.Dec()
+			streamDropped.Inc()
+		}
+	}
+}
+
+// streamLogs handles GET /logs/stream, a Server-Sent Events feed of incoming
+// access logs. It supports the service, method, path (prefix) and status
+// (e.g. 5xx) filters.
+func streamLogs(h *hub, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := streamFilter{
+		Service:    query.Get("service"),
+		Method:     strings.ToUpper(query.Get("method")),
+		PathPrefix: query.Get("path"),
+	}
+	if status := query.Get("status"); status != "" {
+		if len(status) != 3 || status[0] < '1' || status[0] > '5' || strings.ToLower(status[1:]) != "xx" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid status value, expected a class such as 5xx.")
+			return
+		}
+		filter.StatusClass = int(status[0] - '0')
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Streaming is not supported.")
+		return
+	}
+
+	sub := h.subscribe(filter)
+	if sub == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Too many stream subscribers.")
+		return
+	}
+	defer h.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable buffering in the nginx ingress
+	w.WriteHeader(http.StatusOK)
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveEvery)
+	defer keepAlive.Stop()
+
+	// send writes an event and reports whether the client is still there.
+	send := func(format string, args ...interface{}) bool {
+		rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	for {
+		var ok bool
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.dropped:
+			send("event: dropped\ndata: the client did not keep up with the stream\n\n")
+			return
+		case <-keepAlive.C:
+			ok = send(": keep-alive\n\n")
+		case rec := <-sub.records:
+			data, _ := json.Marshal(rec)
+			ok = send("id: %s/%s\nevent: log\ndata: %s\n\n", rec.Service, rec.EventID, data)
+		}
+		if !ok {
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestStreamFilter(t *testing.T) {
+	rec := Record{Service: "service1", Method: "POST", Path: "/users/7/orders", Status: 502}
+	tests := []struct {
+		filter streamFilter
+		want   bool
+	}{
+		{streamFilter{}, true},
+		{streamFilter{Service: "service1", Method: "POST", PathPrefix: "/users/", StatusClass: 5}, true},
+		{streamFilter{Service: "service2"}, false},
+		{streamFilter{PathPrefix: "/products"}, false},
+		{streamFilter{StatusClass: 2}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.matches(rec); got != test.want {
+			t.Errorf("%+v matches got %v want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	h := newHub()
+	slow := h.subscribe(streamFilter{})
+	other := h.subscribe(streamFilter{Service: "service2"})
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		h.publish(Record{Service: "service1"})
+	}
+
+	select {
+	case <-slow.dropped:
+	default:
+		t.Error("subscriber with a full buffer was not dropped")
+	}
+	select {
+	case <-other.dropped:
+		t.Error("subscriber not matching the records was dropped")
+	default:
+	}
+	if len(h.subs) != 1 {
+		t.Errorf("got %d subscribers want 1", len(h.subs))
+	}
+}
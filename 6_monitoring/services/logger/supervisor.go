@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+
+	"common/event"
+)
+
+const (
+	// restartDelay is the pause before a crashed worker is started again.
+	restartDelay = 5 * time.Second
+	// maxCrashes is the number of crashes in a row on the same message after
+	// which the message is skipped.
+	maxCrashes = 3
+
+	// Transient errors are retried with a backoff between these bounds.
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+
+	// commitTimeout bounds committing the last message during shutdown.
+	commitTimeout = 5 * time.Second
+)
+
+var (
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logger_messages_consumed_total",
+		Help: "Number of messages consumed per topic and partition",
+	}, []string{"topic", "partition"})
+
+	decodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logger_decode_failures_total",
+		Help: "Number of messages that could not be decoded as valid access logs per topic and partition",
+	}, []string{"topic", "partition"})
+
+	processingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "logger_message_processing_duration_seconds",
+		Help:    "Time taken to process a message, including storing it, per topic and partition",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic", "partition"})
+
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "logger_consumer_lag",
+		Help: "Number of messages between the last offset committed by this replica and the high watermark, per topic and partition",
+	}, []string{"topic", "partition"})
+
+	workerRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logger_worker_restarts_total",
+		Help: "Number of times a topic worker crashed and was restarted",
+	}, []string{"topic"})
+
+	skippedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logger_skipped_messages_total",
+		Help: "Number of messages skipped because handling them crashed the worker repeatedly, per topic",
+	}, []string{"topic"})
+
+	workersRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "logger_workers",
+		Help: "Number of topics being consumed",
+	})
+)
+
+// supervisor runs one worker per topic and restarts workers that crash.
+// Errors that retrying cannot fix are reported on fatal.
+type supervisor struct {
+	brokers []string
+	groupID string
+	store   Store
+	hub     *hub
+	// deadLetters receives malformed messages, nil if they are only logged.
+	deadLetters publisher
+	fatal       chan error
+	wg          sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newSupervisor(brokers []string, groupID string, store Store, hub *hub, deadLetters publisher) *supervisor {
+	return &supervisor{
+		brokers:     brokers,
+		groupID:     groupID,
+		store:       store,
+		hub:         hub,
+		deadLetters: deadLetters,
+		fatal:       make(chan error, 1),
+		running:     make(map[string]bool),
+	}
+}
+
+// fail reports a fatal error. Only the first one is kept.
+func (s *supervisor) fail(err error) {
+	select {
+	case s.fatal <- err:
+	default:
+	}
+}
+
+// wait waits until all workers have stopped or ctx is done.
+func (s *supervisor) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// panicError is returned by a worker that panicked.
+type panicError struct {
+	value interface{}
+	// msg is the message being handled, nil if the worker was not handling
+	// one.
+	msg *kafka.Message
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// crashes counts the crashes of a worker in a row on the same message.
+type crashes struct {
+	partition int
+	offset    int64
+	count     int
+	last      error
+}
+
+// record records a crash and reports whether its message has crashed the
+// worker maxCrashes times in a row.
+func (c *crashes) record(crash panicError) bool {
+	if crash.msg == nil {
+		*c = crashes{}
+		return false
+	}
+	if c.count == 0 || crash.msg.Partition != c.partition || crash.msg.Offset != c.offset {
+		*c = crashes{partition: crash.msg.Partition, offset: crash.msg.Offset}
+	}
+	c.count++
+	c.last = crash
+	return c.count >= maxCrashes
+}
+
+// poison reports whether msg is to be skipped, as it keeps crashing the
+// worker.
+func (c *crashes) poison(msg kafka.Message) bool {
+	return c.count >= maxCrashes && msg.Partition == c.partition && msg.Offset == c.offset
+}
+
+// start starts a worker for topic unless one is running already.
+func (s *supervisor) start(ctx context.Context, topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[topic] {
+		return
+	}
+	s.running[topic] = true
+	workersRunning.Inc()
+	log.Printf("[%s] Starting worker", topic)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer workersRunning.Dec()
+
+		var crashed crashes
+		for {
+			err := s.runWorker(ctx, topic, &crashed)
+			var crash panicError
+			switch {
+			case err == nil:
+				log.Printf("[%s] Worker stopped", topic)
+				return
+			case !errors.As(err, &crash):
+				s.fail(fmt.Errorf("worker for topic %s: %w", topic, err))
+				return
+			}
+
+			log.Printf("[%s] Worker crashed, restarting in %s: %s", topic, restartDelay, err)
+			workerRestarts.WithLabelValues(topic).Inc()
+			if crashed.record(crash) {
+				log.Printf("[%s/%d@%d] Message crashed the worker %d times, skipping it", topic, crashed.partition, crashed.offset, crashed.count)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(restartDelay):
+			}
+		}
+	}()
+}
+
+// runWorker consumes topic until ctx is done, retrying transient errors with
+// an exponential backoff. Messages that crashed the worker repeatedly are
+// skipped. It returns nil on cancellation, a panicError if handling a message
+// panicked and any other error if consuming cannot go on.
+func (s *supervisor) runWorker(ctx context.Context, topic string, crashed *crashes) (err error) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  s.brokers,
+		GroupID:  s.groupID,
+		Topic:    topic,
+		MinBytes: 10e3,
+		MaxBytes: 10e6,
+	})
+	defer reader.Close()
+
+	var current *kafka.Message
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError{value: r, msg: current}
+		}
+	}()
+
+	lag := newLagTracker(s.brokers, topic)
+	lagCtx, stopLag := context.WithCancel(ctx)
+	lagDone := make(chan struct{})
+	go func() {
+		defer close(lagDone)
+		lag.run(lagCtx)
+	}()
+	defer func() {
+		stopLag()
+		<-lagDone
+		lag.clear()
+	}()
+
+	backoff := minRetryBackoff
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !isTransient(err) {
+				return err
+			}
+			log.Printf("[%s] Error reading message, retrying in %s: %s", topic, backoff, err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = minRetryBackoff
+
+		lag.fetched(msg)
+
+		partition := strconv.Itoa(msg.Partition)
+		if crashed.poison(msg) {
+			if !s.skip(ctx, msg, crashed.last) {
+				return nil
+			}
+		} else {
+			current = &msg
+			timer := prometheus.NewTimer(processingDuration.WithLabelValues(topic, partition))
+			if !s.handle(ctx, msg) {
+				return nil
+			}
+			timer.ObserveDuration()
+			current = nil
+		}
+		messagesConsumed.WithLabelValues(topic, partition).Inc()
+
+		// Commit only after the message is processed, so that a crash
+		// redelivers it to another replica instead of losing it. The commit
+		// of the last message still goes through during shutdown.
+		commitCtx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+		err = reader.CommitMessages(commitCtx, msg)
+		cancel()
+		if err != nil {
+			log.Printf("[%s] Error committing message: %s", topic, err)
+			continue
+		}
+		lag.committed(msg)
+	}
+}
+
+// handle logs a message and, if it is an access log, stores it and, unless
+// it was stored before, sends it to the live tail and counts it in the
+// request metrics. Malformed messages go
+// to the dead-letter topic instead. Storing and dead-lettering are retried
+// until they succeed; handle returns false if ctx is done first.
+func (s *supervisor) handle(ctx context.Context, msg kafka.Message) bool {
+	log.Printf("[%s/%d@%d] Received message: %s\n", msg.Topic, msg.Partition, msg.Offset, describe(msg))
+
+	e, err := event.Decode(msg)
+	if err == nil && e.Type != event.AccessLogKind.Type {
+		return true
+	}
+	var data event.AccessLog
+	if err == nil {
+		data, err = decodeAccessLog(e)
+	}
+	if err != nil {
+		return s.deadLetter(ctx, msg, err)
+	}
+	rec := newRecord(e, data, msg.Topic, msg.Partition, msg.Offset)
+
+	return retry(ctx, msg, "store message", func() error {
+		inserted, err := s.store.Insert(ctx, rec)
+		if err != nil {
+			return err
+		}
+		// A redelivered record was already published and counted.
+		if inserted {
+			s.hub.publish(rec)
+			observeRequest(e.Source, data)
+		}
+		return nil
+	})
+}
+
+// deadLetter counts a malformed message and sends it to the dead-letter topic
+// with the reason it was rejected.
+func (s *supervisor) deadLetter(ctx context.Context, msg kafka.Message, reason error) bool {
+	log.Printf("[%s/%d@%d] Malformed message: %s", msg.Topic, msg.Partition, msg.Offset, reason)
+	decodeFailures.WithLabelValues(msg.Topic, strconv.Itoa(msg.Partition)).Inc()
+	return s.publishDeadLetter(ctx, msg, reason)
+}
+
+// skip counts a message that kept crashing the worker and sends it to the
+// dead-letter topic with the crash as the reason.
+func (s *supervisor) skip(ctx context.Context, msg kafka.Message, reason error) bool {
+	log.Printf("[%s/%d@%d] Skipping message: %s", msg.Topic, msg.Partition, msg.Offset, reason)
+	skippedMessages.WithLabelValues(msg.Topic).Inc()
+	return s.publishDeadLetter(ctx, msg, reason)
+}
+
+// publishDeadLetter sends msg to the dead-letter topic, if there is one.
+func (s *supervisor) publishDeadLetter(ctx context.Context, msg kafka.Message, reason error) bool {
+	if s.deadLetters == nil {
+		return true
+	}
+	return retry(ctx, msg, "dead-letter message", func() error {
+		if err := s.deadLetters.WriteMessages(ctx, deadLetterMessage(msg, reason)); err != nil {
+			return err
+		}
+		deadLettered.WithLabelValues(msg.Topic).Inc()
+		return nil
+	})
+}
+
+// retry calls fn with an exponential backoff until it succeeds, returning
+// false if ctx is done first. action describes fn for the log.
+func retry(ctx context.Context, msg kafka.Message, action string, fn func() error) bool {
+	backoff := minRetryBackoff
+	for {
+		err := fn()
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Printf("[%s/%d@%d] Failed to %s, retrying in %s: %s", msg.Topic, msg.Partition, msg.Offset, action, backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	if d *= 2; d > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return d
+}
+
+// isTransient reports whether a read error may go away by retrying: network
+// errors and the errors Kafka marks as temporary, such as leader elections.
+func isTransient(err error) bool {
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		return kafkaErr.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// watch starts workers for topics matching pattern, checking the cluster
+// for new topics every interval until ctx is done.
+func (s *supervisor) watch(ctx context.Context, pattern *regexp.Regexp, interval time.Duration) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			topics, err := listTopics(ctx, s.brokers)
+			if err != nil && ctx.Err() == nil {
+				log.Println("Failed to list topics:", err)
+			}
+			for _, topic := range matchTopics(pattern, topics) {
+				s.start(ctx, topic)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// listTopics returns the names of all topics in the cluster, asking each
+// broker in turn until one answers.
+func listTopics(ctx context.Context, brokers []string) ([]string, error) {
+	err := errors.New("no Kafka brokers configured")
+	for _, broker := range brokers {
+		var partitions []kafka.Partition
+		partitions, err = readPartitions(ctx, broker)
+		if err != nil {
+			continue
+		}
+		var topics []string
+		seen := make(map[string]bool)
+		for _, p := range partitions {
+			if !seen[p.Topic] {
+				seen[p.Topic] = true
+				topics = append(topics, p.Topic)
+			}
+		}
+		return topics, nil
+	}
+	return nil, err
+}
+
+func readPartitions(ctx context.Context, broker string) ([]kafka.Partition, error) {
+	var dialer kafka.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ReadPartitions()
+}
+
+// matchTopics returns the topics matching pattern in sorted order, leaving
+// out Kafka's internal topics.
+func matchTopics(pattern *regexp.Regexp, topics []string) []string {
+	var matched []string
+	for _, topic := range topics {
+		if len(topic) > 0 && topic[0] != '_' && pattern.MatchString(topic) {
+			matched = append(matched, topic)
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
@@ -9,26 +10,92 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
+
+	"common/accesslog"
+	"common/envconfig"
+	"common/etag"
+	"common/event"
+	"common/idempotency"
+	"common/kafkaconfig"
+	"common/mergepatch"
+	"common/outbox"
+	"common/pagination"
+	"common/producer"
+	"common/softdelete"
+	"service1/productclient"
+)
+
+// serviceName is the source of the events published by this service.
+const serviceName = "service1"
+
+// Domain events published through the outbox. Their data is the user or,
+// for eventOrderPlaced, the order.
+var (
+	eventUserCreated  = event.Kind{Type: "UserCreated", SchemaVersion: 1}
+	eventUserUpdated  = event.Kind{Type: "UserUpdated", SchemaVersion: 1}
+	eventUserDeleted  = event.Kind{Type: "UserDeleted", SchemaVersion: 1}
+	eventUserRestored = event.Kind{Type: "UserRestored", SchemaVersion: 1}
+	eventOrderPlaced  = event.Kind{Type: "OrderPlaced", SchemaVersion: 1}
 )
 
+// LastOrderedProduct is the response of GET /users/product/{id}.
 type LastOrderedProduct struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Price int    `json:"price"`
+	User    User                  `json:"user"`
+	Product productclient.Product `json:"product"`
 }
 
 type User struct {
-	ID                 int    `json:"id"`
-	Username           string `json:"username"`
-	Email              string `json:"email"`
-	LastOrderedProduct int    `json:"last_ordered_product"`
+	ID                 int        `json:"id"`
+	Username           string     `json:"username"`
+	Email              string     `json:"email"`
+	LastOrderedProduct int        `json:"last_ordered_product"`
+	MaxPrice           *int       `json:"max_price"`
+	DeletedAt          *time.Time `json:"deleted_at,omitempty"`
+	Version            int        `json:"-"`
+}
+
+// userColumns lists the users table columns in the order expected by scanUser.
+// last_ordered_product is derived from the most recent row in orders.
+const userColumns = `id, username, email,
+	COALESCE((SELECT product_id FROM orders WHERE orders.user_id = users.id ORDER BY orders.id DESC LIMIT 1), 0),
+	max_price, deleted_at, version`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// userErrors validates each writable user field and returns one message per
+// invalid field.
+func userErrors(user User) []string {
+	var errs []string
+	if user.Username == "" {
+		errs = append(errs, "username must not be empty")
+	}
+	if user.Email == "" {
+		errs = append(errs, "email must not be empty")
+	}
+	if user.MaxPrice != nil && *user.MaxPrice < 0 {
+		errs = append(errs, "max_price must not be negative")
+	}
+	return errs
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.LastOrderedProduct, &user.MaxPrice, &user.DeletedAt, &user.Version)
+	return user, err
 }
 
 var (
@@ -79,30 +146,145 @@ func main() {
 		db.Close()
 	}()
 
-	// Initialize Kafka writer
-	serviceLogWriter := initKafkaWriter()
+	// Initialize products service client
+	productsConfig, err := productclient.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	products := productclient.New(productsConfig)
+
+	// Initialize idempotency key store
+	idempotencyTTL, err := envconfig.Duration("IDEMPOTENCY_TTL", 24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idempotencyKeys := idempotency.NewStore(db, idempotencyTTL)
+	go idempotencyKeys.RunPurge(context.Background(), time.Hour)
+
+	// Initialize purging of soft-deleted users
+	retention, err := envconfig.Duration("SOFT_DELETE_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Users with orders are kept, deleting them would cascade to the orders.
+	go softdelete.RunPurge(context.Background(), db, softdelete.Table{
+		Name:       "users",
+		Referenced: "EXISTS (SELECT 1 FROM orders WHERE orders.user_id = users.id)",
+	}, retention, time.Hour)
+
+	// Initialize Kafka delivery settings
+	kafkaConfig, err := kafkaconfig.WriterConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check the Kafka topics in the background, /ready fails while one is missing
+	topicConfig, err := kafkaconfig.TopicConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	topics := []string{os.Getenv("KAFKA_TOPIC"), os.Getenv("KAFKA_EVENTS_TOPIC")}
+	topicCheck := kafkaconfig.NewTopicCheck([]string{os.Getenv("KAFKA_HOST")}, topics, topicConfig)
+	go topicCheck.Run(context.Background(), 30*time.Second)
+
+	// Initialize publishing of access logs. They are queued and written in
+	// batches; LOG_QUEUE_OVERFLOW decides what happens when the queue is full
+	// and those Kafka does not take are kept in LOG_SPOOL_DIR, if set.
+	logQueue, err := producer.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	shutdownTimeout, err := envconfig.Duration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logWriter := initKafkaWriter(kafkaConfig)
+	if err := producer.CheckWriter(logWriter, logQueue); err != nil {
+		log.Fatal(err)
+	}
+	accessLogs := producer.New("access_logs", logWriter, logQueue)
+
+	// Initialize publishing of domain events
+	outboxInterval, err := envconfig.Duration("OUTBOX_POLL_INTERVAL", time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventWriter := initEventWriter(kafkaConfig)
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		outbox.NewRelay(db, eventWriter, serviceName, outboxInterval).Run(relayCtx)
+	}()
 
 	// Initialize HTTP routes
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := topicCheck.Err(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Not ready: %s", err.Error())
+			return
+		}
+		fmt.Fprintf(w, "Ready.")
+	})
 
-	http.HandleFunc("/users", logRequests(serviceLogWriter, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/users", logRequests(accessLogs, func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			getUsers(db, w, r)
+			getUsers(db, products, w, r)
 		case http.MethodPost:
-			createUser(db, w, r)
+			idempotencyKeys.Handle(w, r, func(w http.ResponseWriter, r *http.Request) {
+				createUser(db, w, r)
+			})
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			fmt.Fprintf(w, "Unsupported request method.")
 		}
 	}))
 
-	http.HandleFunc("/users/", logRequests(serviceLogWriter, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/users/", logRequests(accessLogs, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/orders/latest") {
+			switch r.Method {
+			case http.MethodGet:
+				getLatestOrder(db, products, w, r)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				fmt.Fprintf(w, "Unsupported request method.")
+			}
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, ":restore") {
+			switch r.Method {
+			case http.MethodPost:
+				restoreUser(db, w, r)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				fmt.Fprintf(w, "Unsupported request method.")
+			}
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/orders") {
+			switch r.Method {
+			case http.MethodGet:
+				getOrders(db, w, r)
+			case http.MethodPost:
+				createOrder(db, products, w, r)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				fmt.Fprintf(w, "Unsupported request method.")
+			}
+			return
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			getUser(db, w, r)
 		case http.MethodPut:
 			updateUser(db, w, r)
+		case http.MethodPatch:
+			patchUser(db, w, r)
 		case http.MethodDelete:
 			deleteUser(db, w, r)
 		default:
@@ -111,67 +293,151 @@ func main() {
 		}
 	}))
 
-	http.HandleFunc("/users/product/", logRequests(serviceLogWriter, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/users/product/", logRequests(accessLogs, func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			getLastOrderedProduct(db, w, r)
+			getLastOrderedProduct(db, products, w, r)
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			fmt.Fprintf(w, "Unsupported request method.")
 		}
 	}))
 
-	// Start HTTP server
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	http.HandleFunc("/orders/products", logRequests(accessLogs, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getOrderedProducts(db, w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "Unsupported request method.")
+		}
+	}))
+
+	// Start the HTTP server
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		log.Println("Server listening on :8080")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for the termination signal, then stop the outbox relay, finish the
+	// open requests and flush the queued access logs
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	<-signalCh
+	log.Println("Shutting down...")
+	stopRelay()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	if err := accessLogs.Close(shutdownCtx); err != nil {
+		log.Println("Access logs were not flushed within", shutdownTimeout)
+	}
+	logWriter.Close()
+
+	// Events of a batch cut short stay pending and are published again
+	select {
+	case <-relayDone:
+	case <-shutdownCtx.Done():
+		log.Println("Outbox relay did not stop within", shutdownTimeout)
+	}
+	eventWriter.Close()
 }
 
-func initKafkaWriter() *kafka.Writer {
-	kafkaWriter := kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  []string{"localhost:9092"},
-		Topic:    "service-log",
-		Balancer: &kafka.LeastBytes{},
-	})
-	return kafkaWriter
+func initKafkaWriter(config kafkaconfig.WriterConfig) *kafka.Writer {
+	brokers := []string{os.Getenv("KAFKA_HOST")}
+	topic := os.Getenv("KAFKA_TOPIC")
+	return config.NewWriter(brokers, topic, &kafka.LeastBytes{})
+}
+
+// initEventWriter returns the writer for the domain events topic. Events are
+// keyed by their entity, so the hash balancer keeps the events of an entity
+// in order on one partition. The writer is always synchronous, since the
+// outbox marks events sent once WriteMessages returns.
+func initEventWriter(config kafkaconfig.WriterConfig) *kafka.Writer {
+	config.Async = false
+	return config.NewWriter([]string{os.Getenv("KAFKA_HOST")}, os.Getenv("KAFKA_EVENTS_TOPIC"), &kafka.Hash{})
 }
 
-func logRequests(serviceLogWriter *kafka.Writer, next http.HandlerFunc) http.HandlerFunc {
+func logRequests(accessLogs *producer.Producer, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Notify broker
-		go func() {
-			logData := map[string]interface{}{
-				"method": r.Method,
-				"path":   r.URL.Path,
-				"ip":     r.RemoteAddr,
-			}
-			logBytes, _ := json.Marshal(logData)
-			kafkaWriter.WriteMessages(
-				context.Background(),
-				kafka.Message{
-					Value: logBytes,
-				},
-			)
-		}()
+		r = r.WithContext(event.WithTraceID(r.Context(), event.RequestTraceID(r)))
+		requestID := accesslog.RequestID(r)
+		w.Header().Set(accesslog.RequestIDHeader, requestID)
+		recorder := accesslog.NewResponseWriter(w)
 
 		httpRequestsTotal.Inc()
-		timer := prometheus.NewTimer(httpRequestDuration)
-		next(w, r)
-		timer.ObserveDuration()
+		start := time.Now()
+		next(recorder, r)
+		duration := time.Since(start)
+		httpRequestDuration.Observe(duration.Seconds())
+
+		// Notify broker once the response is complete
+		e, _ := event.New(r.Context(), serviceName, event.AccessLogKind, accesslog.New(r, recorder, requestID, duration))
+		accessLogs.Publish(e.Message())
 	}
 }
 
-func getUsers(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+// getUsers handles GET /users. It supports the shared pagination parameters
+// (limit, cursor, sort by id, username or email), the email and
+// username_prefix filters and include_deleted.
+func getUsers(db *sql.DB, products *productclient.Client, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	expand := query.Get("expand")
+	if expand != "" && expand != "last_ordered_product" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported expand value.")
+		return
+	}
+
+	params, err := pagination.ParseParams(query, "username", "email")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid pagination parameters: %s", err.Error())
+		return
+	}
+
+	var conds []string
+	var args []interface{}
+	if !softdelete.IncludeDeleted(r) {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if email := query.Get("email"); email != "" {
+		args = append(args, email)
+		conds = append(conds, fmt.Sprintf("email = $%d", len(args)))
+	}
+	if prefix := query.Get("username_prefix"); prefix != "" {
+		args = append(args, likePrefix(prefix))
+		conds = append(conds, fmt.Sprintf("username LIKE $%d", len(args)))
+	}
+	if cond, keysetArgs := params.Keyset(len(args) + 1); cond != "" {
+		args = append(args, keysetArgs...)
+		conds = append(conds, cond)
+	}
+
+	sqlQuery := "SELECT " + userColumns + " FROM users"
+	if len(conds) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, params.FetchLimit())
+	sqlQuery += fmt.Sprintf(" ORDER BY %s LIMIT $%d", params.OrderBy(), len(args))
+
 	timer := prometheus.NewTimer(dbQueryDuration)
-	rows, err := db.Query("SELECT * FROM users")
+	rows, err := db.Query(sqlQuery, args...)
 	timer.ObserveDuration()
 	if err != nil {
 		http.Error(w, "Failed to query users", http.StatusInternalServerError)
 		return
 	}
 
+	defer rows.Close()
+
 	var users []User
 	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.LastOrderedProduct)
+		user, err := scanUser(rows)
 		if err != nil {
 			http.Error(w, "Failed to scan user", http.StatusInternalServerError)
 			return
@@ -179,8 +445,35 @@ func getUsers(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		users = append(users, user)
 	}
 
+	page := pagination.New(users, params, func(u User) (string, int) {
+		switch params.Sort.Field {
+		case "username":
+			return u.Username, u.ID
+		case "email":
+			return u.Email, u.ID
+		}
+		return "", u.ID
+	})
+
+	if expand != "" {
+		expanded, err := expandLastOrderedProducts(r.Context(), products, page.Items)
+		if err != nil {
+			writeProductError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pagination.Page[ExpandedUser]{Items: expanded, NextCursor: page.NextCursor})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(page)
+}
+
+// likePrefix turns s into a LIKE pattern matching strings that start with s.
+func likePrefix(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return r.Replace(s) + "%"
 }
 
 func getUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
@@ -193,11 +486,11 @@ func getUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	}
 
 	timer := prometheus.NewTimer(dbQueryDuration)
-	row := db.QueryRow("SELECT * FROM users WHERE id = $1", id)
+	row := db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1 AND ($2 OR deleted_at IS NULL)", id, softdelete.IncludeDeleted(r))
 	timer.ObserveDuration()
 
-	var user User
-	if err := row.Scan(&user.ID, &user.Username, &user.Email, &user.LastOrderedProduct); err != nil {
+	user, err := scanUser(row)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintf(w, "User not found.")
@@ -208,6 +501,13 @@ func getUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tag := etag.Format(user.Version)
+	w.Header().Set("ETag", tag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etag.MatchWeak(ifNoneMatch, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
@@ -220,14 +520,14 @@ func createUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.Username == "" || user.Email == "" {
+	if len(userErrors(user)) > 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Invalid user data.")
 		return
 	}
 
 	timer := prometheus.NewTimer(dbQueryDuration)
-	err := db.QueryRow("INSERT INTO users (username, email, last_ordered_product) VALUES ($1, $2, $3) RETURNING id", user.Username, user.Email, user.LastOrderedProduct).Scan(&user.ID)
+	err := insertUser(r.Context(), db, &user)
 	timer.ObserveDuration()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -235,10 +535,38 @@ func createUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag.Format(user.Version))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
 
+// insertUser stores a new user. A last_ordered_product supplied by older
+// clients is recorded as the user's first order.
+func insertUser(ctx context.Context, db *sql.DB, user *User) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("INSERT INTO users (username, email, max_price) VALUES ($1, $2, $3) RETURNING id, version", user.Username, user.Email, user.MaxPrice).Scan(&user.ID, &user.Version)
+	if err != nil {
+		return err
+	}
+
+	if user.LastOrderedProduct != 0 {
+		_, err = tx.Exec("INSERT INTO orders (user_id, product_id) VALUES ($1, $2)", user.ID, user.LastOrderedProduct)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := outbox.Add(ctx, tx, "user", user.ID, eventUserCreated, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func updateUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Path[len("/users/"):]
 	id, err := strconv.Atoi(idStr)
@@ -255,33 +583,58 @@ func updateUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.Username == "" || user.Email == "" {
+	if len(userErrors(user)) > 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Invalid user data.")
 		return
 	}
 
-	timer := prometheus.NewTimer(dbQueryDuration)
-	result, err := db.Exec("UPDATE users SET username = $1, email = $2 WHERE id = $3", user.Username, user.Email, id)
-	timer.ObserveDuration()
+	expected, ok := userPrecondition(db, w, r, id)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Failed to update user in the database: %s", err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "User not found.")
+	timer := prometheus.NewTimer(dbQueryDuration)
+	row := tx.QueryRow("UPDATE users SET username = $1, email = $2, max_price = $3, version = version + 1 WHERE id = $4 AND deleted_at IS NULL AND ($5::int IS NULL OR version = $5) RETURNING "+userColumns, user.Username, user.Email, user.MaxPrice, id, expected)
+	timer.ObserveDuration()
+
+	updated, err := scanUser(row)
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "user", id, eventUserUpdated, updated)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to update user in the database: %s", err.Error())
+		} else if expected != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, "User was modified by another request.")
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "User not found.")
+		}
 		return
 	}
 
+	w.Header().Set("ETag", etag.Format(updated.Version))
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "User updated successfully.")
 }
 
-func deleteUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+// patchUser handles PATCH /users/{id} with a JSON Merge Patch (RFC 7386)
+// body and responds with the full updated user.
+func patchUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Path[len("/users/"):]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -290,19 +643,187 @@ func deleteUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !mergepatch.SupportedContentType(r.Header.Get("Content-Type")) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "Expected %s body.", mergepatch.ContentType)
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user data.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to update user in the database: %s", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
 	timer := prometheus.NewTimer(dbQueryDuration)
-	result, err := db.Exec("DELETE FROM users WHERE id = $1", id)
+	row := tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id)
 	timer.ObserveDuration()
+
+	user, err := scanUser(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			status := http.StatusNotFound
+			if r.Header.Get("If-Match") != "" {
+				status = http.StatusPreconditionFailed
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "User not found.")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to get user from the database: %s", err.Error())
+		}
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etag.MatchStrong(ifMatch, etag.Format(user.Version)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "User was modified by another request.")
+		return
+	}
+
+	current, _ := json.Marshal(user)
+	merged, err := mergepatch.Apply(current, patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid merge patch: %s", err.Error())
+		return
+	}
+
+	var patched User
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patched); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user data: %s", err.Error())
+		return
+	}
+
+	errs := userErrors(patched)
+	if patched.ID != user.ID {
+		errs = append(errs, "id is read-only")
+	}
+	if patched.DeletedAt != nil {
+		errs = append(errs, "deleted_at is read-only")
+	}
+	if patched.LastOrderedProduct != user.LastOrderedProduct {
+		errs = append(errs, "last_ordered_product is read-only, place an order instead")
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user data: %s.", strings.Join(errs, "; "))
+		return
+	}
+
+	timer = prometheus.NewTimer(dbQueryDuration)
+	err = tx.QueryRow("UPDATE users SET username = $1, email = $2, max_price = $3, version = version + 1 WHERE id = $4 RETURNING version", patched.Username, patched.Email, patched.MaxPrice, id).Scan(&patched.Version)
+	timer.ObserveDuration()
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "user", id, eventUserUpdated, patched)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to update user in the database: %s", err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", etag.Format(patched.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(patched)
+}
+
+// userPrecondition evaluates the If-Match header of r against the stored
+// user. It returns the version a conditional write must still match, or nil
+// when r has no If-Match header. After writing a 412 response it returns
+// false.
+func userPrecondition(db *sql.DB, w http.ResponseWriter, r *http.Request, id int) (*int, bool) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil, true
+	}
+
+	var version int
+	timer := prometheus.NewTimer(dbQueryDuration)
+	err := db.QueryRow("SELECT version FROM users WHERE id = $1 AND deleted_at IS NULL", id).Scan(&version)
+	timer.ObserveDuration()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// If-Match never matches a missing user, not even "*".
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, "User not found.")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to get user from the database: %s", err.Error())
+		}
+		return nil, false
+	}
+
+	if !etag.MatchStrong(ifMatch, etag.Format(version)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "User was modified by another request.")
+		return nil, false
+	}
+	return &version, true
+}
+
+// deleteUser handles DELETE /users/{id}. Users are only marked as deleted
+// and purged after the retention period unless they have orders; see
+// restoreUser.
+func deleteUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Path[len("/users/"):]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user ID.")
+		return
+	}
+
+	expected, ok := userPrecondition(db, w, r, id)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Failed to delete user from the database: %s", err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "User not found.")
+	timer := prometheus.NewTimer(dbQueryDuration)
+	row := tx.QueryRow("UPDATE users SET deleted_at = now(), version = version + 1 WHERE id = $1 AND deleted_at IS NULL AND ($2::int IS NULL OR version = $2) RETURNING "+userColumns, id, expected)
+	timer.ObserveDuration()
+
+	user, err := scanUser(row)
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "user", id, eventUserDeleted, user)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to delete user from the database: %s", err.Error())
+		} else if expected != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, "User was modified by another request.")
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "User not found.")
+		}
 		return
 	}
 
@@ -310,7 +831,61 @@ func deleteUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "User deleted successfully.")
 }
 
-func getLastOrderedProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+// restoreUser handles POST /users/{id}:restore, undoing a soft delete.
+func restoreUser(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	id, err := userIDFromPath(r.URL.Path, ":restore")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user ID.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to restore user in the database: %s", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	var user User
+	timer := prometheus.NewTimer(dbQueryDuration)
+	err = softdelete.Restore(r.Context(), tx, "users", id, userColumns, func(row *sql.Row) (err error) {
+		user, err = scanUser(row)
+		return err
+	})
+	timer.ObserveDuration()
+
+	switch err {
+	case softdelete.ErrNotDeleted:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "User is not deleted.")
+		return
+	case sql.ErrNoRows:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "User not found.")
+		return
+	}
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "user", id, eventUserRestored, user)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to restore user in the database: %s", err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", etag.Format(user.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// getLastOrderedProduct handles GET /users/product/{id}, returning the user
+// together with the product they ordered last.
+func getLastOrderedProduct(db *sql.DB, products *productclient.Client, w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Path[len("/users/product/"):]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -318,14 +893,13 @@ func getLastOrderedProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Invalid user ID.")
 		return
 	}
-	fmt.Printf("Parsed user ID: %d\n", id)
 
 	timer := prometheus.NewTimer(dbQueryDuration)
-	row := db.QueryRow("SELECT * FROM users WHERE id = $1", id)
+	row := db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1 AND ($2 OR deleted_at IS NULL)", id, softdelete.IncludeDeleted(r))
 	timer.ObserveDuration()
 
-	var user User
-	if err := row.Scan(&user.ID, &user.Username, &user.Email, &user.LastOrderedProduct); err != nil {
+	user, err := scanUser(row)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintf(w, "User not found.")
@@ -335,27 +909,19 @@ func getLastOrderedProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	fmt.Printf("Fetched user: %#v\n", user)
 
-	productsServiceName := os.Getenv("HELPER_SERVICE")
-	url := fmt.Sprintf("http://%s/products/%d", productsServiceName, user.LastOrderedProduct)
-	fmt.Printf("Sending request to URL: %s\n", url)
-	resp, err := http.Get(url)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Failed to delete user from the database: %s", err.Error())
+	if user.LastOrderedProduct == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "User has no orders.")
 		return
 	}
-	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	product, err := products.Product(r.Context(), user.LastOrderedProduct)
 	if err != nil {
-		fmt.Println("Error:", err)
+		writeProductError(w, err)
 		return
 	}
-	fmt.Println("Got response from another service: ", string(body))
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(string(body))
+	json.NewEncoder(w).Encode(LastOrderedProduct{User: user, Product: product})
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"service1/productclient"
+)
+
+func TestWriteProductError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{productclient.ErrNotFound, http.StatusNotFound},
+		{fmt.Errorf("%w: 504 Gateway Timeout", productclient.ErrTimeout), http.StatusGatewayTimeout},
+		{productclient.ErrCircuitOpen, http.StatusServiceUnavailable},
+		{errors.New("unexpected response from products service: 500"), http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		writeProductError(rr, c.err)
+		if rr.Code != c.want {
+			t.Errorf("error %q mapped to %d, want %d", c.err, rr.Code, c.want)
+		}
+	}
+}
+
+func TestExpandLastOrderedProducts(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if ids := r.URL.Query().Get("ids"); ids != "3,5" {
+			t.Errorf("unexpected ids query: got %q want %q", ids, "3,5")
+		}
+		fmt.Fprint(w, `{"items":[{"id":3,"name":"Chair","price":40}]}`)
+	}))
+	defer server.Close()
+	products := productclient.New(productclient.Config{BaseURL: server.URL})
+
+	users := []User{
+		{ID: 1, LastOrderedProduct: 3},
+		{ID: 2, LastOrderedProduct: 5},
+		{ID: 3, LastOrderedProduct: 3},
+		{ID: 4},
+	}
+	expanded, err := expandLastOrderedProducts(context.Background(), products, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 1 {
+		t.Errorf("products service called %d times, want 1", requests)
+	}
+	if p := expanded[0].LastOrderedProduct; p == nil || p.Name != "Chair" {
+		t.Errorf("user 1 has unexpected product: %+v", p)
+	}
+	if p := expanded[1].LastOrderedProduct; p != nil {
+		t.Errorf("user 2 should have no product, got %+v", p)
+	}
+	if p := expanded[3].LastOrderedProduct; p != nil {
+		t.Errorf("user 4 should have no product, got %+v", p)
+	}
+}
@@ -0,0 +1,11 @@
+ALTER TABLE users
+ADD COLUMN last_ordered_product INTEGER;
+
+UPDATE users SET last_ordered_product = (
+  SELECT product_id FROM orders
+  WHERE orders.user_id = users.id
+  ORDER BY orders.id DESC
+  LIMIT 1
+);
+
+DROP TABLE orders;
@@ -0,0 +1,16 @@
+CREATE TABLE orders (
+  id         SERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  product_id INTEGER NOT NULL,
+  price      INTEGER,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX orders_user_id_idx ON orders (user_id, id DESC);
+
+INSERT INTO orders (user_id, product_id)
+SELECT id, last_ordered_product FROM users
+WHERE last_ordered_product IS NOT NULL AND last_ordered_product <> 0;
+
+ALTER TABLE users
+DROP COLUMN last_ordered_product;
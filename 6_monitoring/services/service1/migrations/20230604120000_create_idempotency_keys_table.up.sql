@@ -0,0 +1,8 @@
+CREATE TABLE idempotency_keys (
+  key         VARCHAR(255) PRIMARY KEY,
+  fingerprint CHAR(64) NOT NULL,
+  status      INTEGER,
+  headers     TEXT,
+  body        BYTEA,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,3 @@
+ALTER TABLE outbox
+DROP COLUMN schema_version,
+DROP COLUMN trace_id;
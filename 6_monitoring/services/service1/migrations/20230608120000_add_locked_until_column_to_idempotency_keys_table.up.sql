@@ -0,0 +1,2 @@
+ALTER TABLE idempotency_keys
+ADD COLUMN locked_until TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"common/outbox"
+	"common/pagination"
+	"service1/productclient"
+)
+
+// Order is a single purchase from the orders table. Price holds the product
+// price at the time of the order and is null for orders migrated from the
+// former users.last_ordered_product column.
+type Order struct {
+	ID        int                    `json:"id"`
+	UserID    int                    `json:"user_id"`
+	ProductID int                    `json:"product_id"`
+	Price     *int                   `json:"price"`
+	CreatedAt time.Time              `json:"created_at"`
+	Product   *productclient.Product `json:"product,omitempty"`
+}
+
+const orderColumns = "id, user_id, product_id, price, created_at"
+
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	err := row.Scan(&order.ID, &order.UserID, &order.ProductID, &order.Price, &order.CreatedAt)
+	return order, err
+}
+
+// userIDFromPath extracts the user ID from paths like /users/{id}{suffix}.
+func userIDFromPath(path, suffix string) (int, error) {
+	return strconv.Atoi(strings.TrimSuffix(path[len("/users/"):], suffix))
+}
+
+// userExists reports whether a user with the given ID is stored.
+func userExists(db *sql.DB, id int) (bool, error) {
+	var exists bool
+	timer := prometheus.NewTimer(dbQueryDuration)
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists)
+	timer.ObserveDuration()
+	return exists, err
+}
+
+// ExpandedUser is a User whose last_ordered_product ID is replaced with the
+// product itself, as returned by GET /users?expand=last_ordered_product.
+type ExpandedUser struct {
+	User
+	LastOrderedProduct *productclient.Product `json:"last_ordered_product"`
+}
+
+// expandLastOrderedProducts embeds each user's last ordered product using a
+// single batch lookup instead of one request per user.
+func expandLastOrderedProducts(ctx context.Context, products *productclient.Client, users []User) ([]ExpandedUser, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, user := range users {
+		if user.LastOrderedProduct != 0 && !seen[user.LastOrderedProduct] {
+			seen[user.LastOrderedProduct] = true
+			ids = append(ids, user.LastOrderedProduct)
+		}
+	}
+
+	byID, err := products.Products(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := make([]ExpandedUser, 0, len(users))
+	for _, user := range users {
+		eu := ExpandedUser{User: user}
+		if product, ok := byID[user.LastOrderedProduct]; ok {
+			eu.LastOrderedProduct = &product
+		}
+		expanded = append(expanded, eu)
+	}
+	return expanded, nil
+}
+
+// writeProductError maps a products client error to an HTTP response: 404 for
+// a missing product, 504 for timeouts, 503 while the circuit breaker is open
+// and 502 for any other upstream failure.
+func writeProductError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, productclient.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Product not found.")
+	case errors.Is(err, productclient.ErrCircuitOpen):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Products service is unavailable: %s", err.Error())
+	case errors.Is(err, productclient.ErrTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		fmt.Fprintf(w, "Timed out getting product from the products service: %s", err.Error())
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Failed to get product from the products service: %s", err.Error())
+	}
+}
+
+// createOrder handles POST /users/{id}/orders. The order is accepted only if
+// the product price fits into the user's max_price budget; on success it is
+// appended to the user's order history.
+func createOrder(db *sql.DB, products *productclient.Client, w http.ResponseWriter, r *http.Request) {
+	id, err := userIDFromPath(r.URL.Path, "/orders")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user ID.")
+		return
+	}
+
+	var order Order
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil || order.ProductID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid order data.")
+		return
+	}
+	order.UserID = id
+
+	timer := prometheus.NewTimer(dbQueryDuration)
+	row := db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id)
+	timer.ObserveDuration()
+
+	user, err := scanUser(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "User not found.")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to get user from the database: %s", err.Error())
+		}
+		return
+	}
+
+	product, err := products.Product(r.Context(), order.ProductID)
+	if err == nil && product.DeletedAt != nil {
+		err = productclient.ErrNotFound
+	}
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+	order.Price = &product.Price
+
+	if user.MaxPrice != nil && product.Price > *user.MaxPrice {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Product price exceeds the user's max price.")
+		return
+	}
+
+	// The budget is checked again in the statement so that a concurrent
+	// change of max_price cannot let an order slip through. The user version
+	// is bumped because the order changes their last_ordered_product.
+	tx, err := db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to save order in the database: %s", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	timer = prometheus.NewTimer(dbQueryDuration)
+	err = tx.QueryRow(`WITH buyer AS (
+			UPDATE users SET version = version + 1
+			WHERE id = $1 AND deleted_at IS NULL AND (max_price IS NULL OR max_price >= $3)
+			RETURNING id
+		)
+		INSERT INTO orders (user_id, product_id, price)
+		SELECT id, $2, $3 FROM buyer
+		RETURNING id, created_at`, id, product.ID, product.Price).Scan(&order.ID, &order.CreatedAt)
+	timer.ObserveDuration()
+	order.Product = &product
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "user", id, eventOrderPlaced, order)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(w, "Product price exceeds the user's max price.")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to save order in the database: %s", err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+// getOrders handles GET /users/{id}/orders. It supports the shared
+// pagination parameters sorted by id, returning the user's orders from newest
+// to oldest unless sort=id is given.
+func getOrders(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	id, err := userIDFromPath(r.URL.Path, "/orders")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user ID.")
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("sort") == "" {
+		query.Set("sort", "-id")
+	}
+	params, err := pagination.ParseParams(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid pagination parameters: %s", err.Error())
+		return
+	}
+
+	exists, err := userExists(db, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to get user from the database: %s", err.Error())
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "User not found.")
+		return
+	}
+
+	conds := "user_id = $1"
+	args := []interface{}{id}
+	if cond, keysetArgs := params.Keyset(len(args) + 1); cond != "" {
+		conds += " AND " + cond
+		args = append(args, keysetArgs...)
+	}
+	args = append(args, params.FetchLimit())
+
+	timer := prometheus.NewTimer(dbQueryDuration)
+	rows, err := db.Query(fmt.Sprintf("SELECT "+orderColumns+" FROM orders WHERE %s ORDER BY %s LIMIT $%d", conds, params.OrderBy(), len(args)), args...)
+	timer.ObserveDuration()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to get orders from the database: %s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to scan orders from the database: %s", err.Error())
+			return
+		}
+		orders = append(orders, order)
+	}
+
+	page := pagination.New(orders, params, func(o Order) (string, int) {
+		return "", o.ID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// OrderedProducts is the response of GET /orders/products.
+type OrderedProducts struct {
+	ProductIDs []int64 `json:"product_ids"`
+}
+
+// getOrderedProducts handles GET /orders/products?ids=, returning which of
+// the products have been ordered. service2 asks before it purges deleted
+// products, so that the orders keep resolving.
+func getOrderedProducts(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var ids []int64
+	for _, part := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid product IDs.")
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > pagination.MaxLimit {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "At most %d product IDs are allowed.", pagination.MaxLimit)
+		return
+	}
+
+	timer := prometheus.NewTimer(dbQueryDuration)
+	rows, err := db.Query("SELECT DISTINCT product_id FROM orders WHERE product_id = ANY($1)", pq.Array(ids))
+	timer.ObserveDuration()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to get orders from the database: %s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	ordered := OrderedProducts{ProductIDs: make([]int64, 0)}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to scan orders from the database: %s", err.Error())
+			return
+		}
+		ordered.ProductIDs = append(ordered.ProductIDs, id)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ordered)
+}
+
+// getLatestOrder handles GET /users/{id}/orders/latest, returning the most
+// recent order together with the current product data from service2.
+func getLatestOrder(db *sql.DB, products *productclient.Client, w http.ResponseWriter, r *http.Request) {
+	id, err := userIDFromPath(r.URL.Path, "/orders/latest")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid user ID.")
+		return
+	}
+
+	exists, err := userExists(db, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to get user from the database: %s", err.Error())
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "User not found.")
+		return
+	}
+
+	timer := prometheus.NewTimer(dbQueryDuration)
+	row := db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE user_id = $1 ORDER BY id DESC LIMIT 1", id)
+	timer.ObserveDuration()
+
+	order, err := scanOrder(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "User has no orders.")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to get order from the database: %s", err.Error())
+		}
+		return
+	}
+
+	// A product removed from service2 leaves the order without product data.
+	product, err := products.Product(r.Context(), order.ProductID)
+	if err != nil && !errors.Is(err, productclient.ErrNotFound) {
+		writeProductError(w, err)
+		return
+	}
+	if err == nil {
+		order.Product = &product
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
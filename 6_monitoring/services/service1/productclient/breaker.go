@@ -0,0 +1,142 @@
+package productclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type state int
+
+const (
+	stateClosed state = iota
+	stateHalfOpen
+	stateOpen
+)
+
+func (s state) String() string {
+	switch s {
+	case stateClosed:
+		return "closed"
+	case stateHalfOpen:
+		return "half_open"
+	default:
+		return "open"
+	}
+}
+
+var (
+	breakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "products_client_breaker_state",
+		Help: "Current state of the products service circuit breaker (0 closed, 1 half-open, 2 open)",
+	})
+
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_client_breaker_transitions_total",
+		Help: "Number of products service circuit breaker state changes",
+	}, []string{"from", "to"})
+)
+
+// breaker is a consecutive-failure circuit breaker. It opens after threshold
+// failures in a row, rejects calls for openDuration and then lets up to
+// halfOpenMax probe calls through; a successful probe closes it again and a
+// failed one reopens it.
+type breaker struct {
+	threshold    int
+	openDuration time.Duration
+	halfOpenMax  int
+	now          func() time.Time
+
+	mu       sync.Mutex
+	state    state
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+func newBreaker(threshold int, openDuration time.Duration, halfOpenMax int) *breaker {
+	breakerState.Set(float64(stateClosed))
+	return &breaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+		halfOpenMax:  halfOpenMax,
+		now:          time.Now,
+	}
+}
+
+// allow reports whether a call may proceed. Every allowed call must be
+// followed by exactly one call to record or release.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateOpen:
+		if b.now().Sub(b.openedAt) < b.openDuration {
+			return ErrCircuitOpen
+		}
+		b.setState(stateHalfOpen)
+		fallthrough
+	case stateHalfOpen:
+		if b.probes >= b.halfOpenMax {
+			return ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// record reports the outcome of a call admitted by allow.
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	case stateHalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		if success {
+			b.failures = 0
+			b.setState(stateClosed)
+		} else {
+			b.open()
+		}
+	}
+}
+
+// release gives back a call admitted by allow without recording an outcome.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == stateHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *breaker) open() {
+	b.openedAt = b.now()
+	b.probes = 0
+	b.setState(stateOpen)
+}
+
+func (b *breaker) setState(s state) {
+	if b.state == s {
+		return
+	}
+	breakerTransitions.WithLabelValues(b.state.String(), s.String()).Inc()
+	breakerState.Set(float64(s))
+	b.state = s
+}
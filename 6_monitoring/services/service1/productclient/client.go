@@ -0,0 +1,355 @@
+// Package productclient is the service1 client for the products service
+// (service2). It applies the same timeout, retry and circuit breaking policy
+// that the Istio VirtualService and DestinationRule provide inside the mesh,
+// so the services behave the same when they run outside of it.
+package productclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"common/envconfig"
+	"common/pagination"
+)
+
+var (
+	ErrNotFound    = errors.New("product not found")
+	ErrTimeout     = errors.New("products service timed out")
+	ErrCircuitOpen = errors.New("products service circuit breaker is open")
+)
+
+// MaxBatchIDs mirrors the per-request ID limit of GET /products?ids= in
+// service2, which equals the page size limit.
+const MaxBatchIDs = pagination.MaxLimit
+
+// maxCachedProducts bounds the number of products kept for conditional GETs.
+const maxCachedProducts = 1024
+
+var (
+	retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "products_client_retries_total",
+		Help: "Number of retried requests to the products service",
+	})
+
+	notModifiedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "products_client_not_modified_total",
+		Help: "Number of product reads answered with 304 Not Modified from the local cache",
+	})
+)
+
+// Product is a product as served by service2. Soft-deleted products are
+// still returned, with DeletedAt set, so that order history keeps resolving.
+type Product struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Price     int        `json:"price"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type Config struct {
+	// BaseURL is the products service root, e.g. http://service2.
+	BaseURL string
+	// Timeout bounds a whole call including retries.
+	Timeout time.Duration
+	// PerTryTimeout bounds a single attempt.
+	PerTryTimeout time.Duration
+	// Retries is the number of additional attempts for idempotent requests.
+	Retries int
+	// RetryBackoff is the base interval of the exponential retry backoff.
+	RetryBackoff time.Duration
+	// ConsecutiveErrors opens the breaker after that many failures in a row.
+	ConsecutiveErrors int
+	// OpenDuration is how long the breaker rejects calls before probing.
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of concurrent probes while half-open.
+	HalfOpenRequests int
+}
+
+// ConfigFromEnv builds a Config from HELPER_SERVICE and the PRODUCTS_* env
+// vars. Defaults mirror k8s/istio/retry-timeout.yaml and Istio's outlier
+// detection defaults:
+//
+//	PRODUCTS_TIMEOUT                     1s
+//	PRODUCTS_PER_TRY_TIMEOUT             1s
+//	PRODUCTS_RETRY_ATTEMPTS              3
+//	PRODUCTS_RETRY_BACKOFF               25ms
+//	PRODUCTS_BREAKER_CONSECUTIVE_ERRORS  5
+//	PRODUCTS_BREAKER_OPEN_DURATION       30s
+//	PRODUCTS_BREAKER_HALF_OPEN_REQUESTS  1
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{BaseURL: "http://" + os.Getenv("HELPER_SERVICE")}
+	var err error
+	if cfg.Timeout, err = envconfig.Duration("PRODUCTS_TIMEOUT", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.PerTryTimeout, err = envconfig.Duration("PRODUCTS_PER_TRY_TIMEOUT", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.Retries, err = envconfig.Count("PRODUCTS_RETRY_ATTEMPTS", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.RetryBackoff, err = envconfig.Duration("PRODUCTS_RETRY_BACKOFF", 25*time.Millisecond); err != nil {
+		return cfg, err
+	}
+	if cfg.ConsecutiveErrors, err = envconfig.Int("PRODUCTS_BREAKER_CONSECUTIVE_ERRORS", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.OpenDuration, err = envconfig.Duration("PRODUCTS_BREAKER_OPEN_DURATION", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.HalfOpenRequests, err = envconfig.Int("PRODUCTS_BREAKER_HALF_OPEN_REQUESTS", 1); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+type Client struct {
+	cfg     Config
+	http    *http.Client
+	breaker *breaker
+
+	mu    sync.Mutex
+	cache map[int]cachedProduct
+}
+
+// cachedProduct is a product together with the ETag it was served with.
+type cachedProduct struct {
+	etag    string
+	product Product
+}
+
+// call describes a single logical request, which may span several attempts.
+type call struct {
+	method      string
+	path        string
+	ifNoneMatch string
+	out         interface{}
+
+	// Filled from the final response.
+	etag        string
+	notModified bool
+}
+
+func New(cfg Config) *Client {
+	if cfg.ConsecutiveErrors <= 0 {
+		cfg.ConsecutiveErrors = 1
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &Client{
+		cfg:     cfg,
+		http:    &http.Client{},
+		breaker: newBreaker(cfg.ConsecutiveErrors, cfg.OpenDuration, cfg.HalfOpenRequests),
+		cache:   make(map[int]cachedProduct),
+	}
+}
+
+// Product loads a single product. Products read before are revalidated with
+// If-None-Match, so unchanged products are not transferred again.
+func (c *Client) Product(ctx context.Context, id int) (Product, error) {
+	c.mu.Lock()
+	cached, ok := c.cache[id]
+	c.mu.Unlock()
+
+	var product Product
+	cl := &call{method: http.MethodGet, path: fmt.Sprintf("/products/%d?include_deleted=true", id), out: &product}
+	if ok {
+		cl.ifNoneMatch = cached.etag
+	}
+
+	err := c.do(ctx, cl)
+	switch {
+	case err == ErrNotFound:
+		c.mu.Lock()
+		delete(c.cache, id)
+		c.mu.Unlock()
+		return Product{}, err
+	case err != nil:
+		return Product{}, err
+	case cl.notModified:
+		notModifiedTotal.Inc()
+		return cached.product, nil
+	}
+
+	if cl.etag != "" {
+		c.mu.Lock()
+		if _, exists := c.cache[id]; !exists && len(c.cache) >= maxCachedProducts {
+			for evict := range c.cache {
+				delete(c.cache, evict)
+				break
+			}
+		}
+		c.cache[id] = cachedProduct{etag: cl.etag, product: product}
+		c.mu.Unlock()
+	}
+	return product, nil
+}
+
+// Products loads the given products using the batch lookup, issuing one
+// request per MaxBatchIDs IDs. Products unknown to service2 are absent from
+// the result.
+func (c *Client) Products(ctx context.Context, ids []int) (map[int]Product, error) {
+	products := make(map[int]Product, len(ids))
+	for start := 0; start < len(ids); start += MaxBatchIDs {
+		end := start + MaxBatchIDs
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		idStrs := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			idStrs = append(idStrs, strconv.Itoa(id))
+		}
+
+		var batch pagination.Page[Product]
+		path := fmt.Sprintf("/products?ids=%s&limit=%d&include_deleted=true", strings.Join(idStrs, ","), MaxBatchIDs)
+		if err := c.getJSON(ctx, path, &batch); err != nil {
+			return nil, err
+		}
+		for _, product := range batch.Items {
+			products[product.ID] = product
+		}
+	}
+	return products, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	return c.do(ctx, &call{method: http.MethodGet, path: path, out: v})
+}
+
+// do performs a call, retrying it only if the method is idempotent.
+func (c *Client) do(ctx context.Context, cl *call) error {
+	caller := ctx
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+
+	retries := 0
+	if cl.method == http.MethodGet || cl.method == http.MethodHead {
+		retries = c.cfg.Retries
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			retriesTotal.Inc()
+			select {
+			case <-time.After(c.backoff(attempt)):
+			case <-ctx.Done():
+				return timeoutErr(ctx, err)
+			}
+		}
+
+		var retry bool
+		retry, err = c.try(caller, ctx, cl)
+		if !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// try performs a single attempt within ctx, the call's own deadline, and
+// reports whether it may be retried. caller is the context the call was made
+// with.
+func (c *Client) try(caller, ctx context.Context, cl *call) (bool, error) {
+	if c.cfg.PerTryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.PerTryTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, cl.method, c.cfg.BaseURL+cl.path, nil)
+	if err != nil {
+		return false, err
+	}
+	if cl.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", cl.ifNoneMatch)
+	}
+
+	if err := c.breaker.allow(); err != nil {
+		return false, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if caller.Err() != nil {
+			// The caller went away or ran out of time; that says nothing
+			// about service2, unlike the call or per-try timeout expiring.
+			c.breaker.release()
+			return false, err
+		}
+		c.breaker.record(false)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true, fmt.Errorf("%w: %s", ErrTimeout, err.Error())
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		c.breaker.record(true)
+		cl.notModified = true
+		return false, nil
+	case http.StatusNotFound:
+		c.breaker.record(true)
+		return false, ErrNotFound
+	case http.StatusGatewayTimeout:
+		c.breaker.record(false)
+		return true, fmt.Errorf("%w: %s", ErrTimeout, resp.Status)
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		c.breaker.record(false)
+		return true, fmt.Errorf("unexpected response from products service: %s", resp.Status)
+	default:
+		c.breaker.record(resp.StatusCode < 500)
+		return false, fmt.Errorf("unexpected response from products service: %s", resp.Status)
+	}
+
+	cl.etag = resp.Header.Get("ETag")
+	if err := json.NewDecoder(resp.Body).Decode(cl.out); err != nil {
+		c.breaker.record(true)
+		return false, fmt.Errorf("failed to decode products service response: %w", err)
+	}
+	c.breaker.record(true)
+	return false, nil
+}
+
+// backoff returns the jittered exponential delay before the given attempt.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.cfg.RetryBackoff << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// timeoutErr reports an expired call deadline as ErrTimeout, keeping the last
+// attempt's error for context.
+func timeoutErr(ctx context.Context, last error) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return ctx.Err()
+	}
+	if last != nil && errors.Is(last, ErrTimeout) {
+		return last
+	}
+	return fmt.Errorf("%w: last attempt: %v", ErrTimeout, last)
+}
@@ -0,0 +1,187 @@
+package productclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProduct(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/products/7" || r.URL.Query().Get("include_deleted") != "true" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		fmt.Fprint(w, `{"id":7,"name":"Lamp","price":25}`)
+	}))
+	defer server.Close()
+
+	product, err := New(Config{BaseURL: server.URL}).Product(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Product{ID: 7, Name: "Lamp", Price: 25}
+	if product != expected {
+		t.Errorf("Product returned unexpected product: got %+v want %+v", product, expected)
+	}
+}
+
+func TestProductRevalidation(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("ETag", `"1"`)
+		if r.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, `{"id":7,"name":"Lamp","price":25}`)
+	}))
+	defer server.Close()
+
+	client := New(Config{BaseURL: server.URL})
+	for i := 0; i < 2; i++ {
+		product, err := client.Product(context.Background(), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if product.Name != "Lamp" {
+			t.Errorf("read %d returned unexpected product: %+v", i, product)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("server called %d times, want 2", calls)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"id":1,"name":"Lamp","price":25}`)
+	}))
+	defer server.Close()
+
+	client := New(Config{BaseURL: server.URL, Retries: 3, RetryBackoff: time.Millisecond, ConsecutiveErrors: 5})
+	if _, err := client.Product(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("server called %d times, want 3", calls)
+	}
+}
+
+func TestNoRetryForNonIdempotentRequests(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := New(Config{BaseURL: server.URL, Retries: 3, RetryBackoff: time.Millisecond, ConsecutiveErrors: 5})
+	if err := client.do(context.Background(), &call{method: http.MethodPost, path: "/products"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("server called %d times, want 1", calls)
+	}
+}
+
+func TestPerTryTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := New(Config{BaseURL: server.URL, PerTryTimeout: 10 * time.Millisecond, ConsecutiveErrors: 5})
+	_, err := client.Product(context.Background(), 1)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(2, time.Minute, 1)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("closed breaker rejected call %d: %v", i, err)
+		}
+		b.record(false)
+	}
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Fatalf("expected open breaker, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("half-open breaker rejected probe: %v", err)
+	}
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Fatalf("half-open breaker admitted a second probe: %v", err)
+	}
+	b.record(false)
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Fatalf("failed probe should reopen the breaker, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("half-open breaker rejected probe: %v", err)
+	}
+	b.record(true)
+	if b.state != stateClosed {
+		t.Errorf("successful probe should close the breaker, state is %s", b.state)
+	}
+}
+
+func TestCallerDeadlineDoesNotOpenBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := New(Config{BaseURL: server.URL, PerTryTimeout: time.Second, ConsecutiveErrors: 1, OpenDuration: time.Minute})
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		_, err := client.Product(ctx, 1)
+		cancel()
+		if errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d: the caller's deadline opened the breaker", i)
+		}
+	}
+	if client.breaker.state != stateClosed {
+		t.Errorf("breaker is %s want closed", client.breaker.state)
+	}
+}
+
+func TestCallTimeoutOpensBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := New(Config{BaseURL: server.URL, Timeout: 20 * time.Millisecond, PerTryTimeout: 20 * time.Millisecond, ConsecutiveErrors: 2, OpenDuration: time.Minute})
+	for i := 0; i < 2; i++ {
+		if _, err := client.Product(context.Background(), 1); !errors.Is(err, ErrTimeout) {
+			t.Errorf("call %d: expected ErrTimeout, got %v", i, err)
+		}
+	}
+	if client.breaker.state != stateOpen {
+		t.Errorf("breaker is %s want open", client.breaker.state)
+	}
+}
@@ -3,6 +3,7 @@ module service2
 go 1.20
 
 require (
+	common v0.0.0
 	github.com/lib/pq v1.10.9
 	github.com/prometheus/client_golang v1.15.1
 	github.com/segmentio/kafka-go v0.4.40
@@ -21,3 +22,5 @@ require (
 	golang.org/x/sys v0.6.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
 )
+
+replace common => ../common
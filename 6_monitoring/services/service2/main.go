@@ -1,26 +1,105 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
+
+	"common/accesslog"
+	"common/envconfig"
+	"common/etag"
+	"common/event"
+	"common/idempotency"
+	"common/kafkaconfig"
+	"common/mergepatch"
+	"common/outbox"
+	"common/pagination"
+	"common/producer"
+	"common/softdelete"
 )
 
 type Product struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Price int    `json:"price"`
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Price     int        `json:"price"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Version   int        `json:"-"`
+}
+
+// serviceName is the source of the events published by this service.
+const serviceName = "service2"
+
+// Domain events published through the outbox. Their data is the product or,
+// for eventProductPriceChanged, a priceChange.
+var (
+	eventProductCreated      = event.Kind{Type: "ProductCreated", SchemaVersion: 1}
+	eventProductUpdated      = event.Kind{Type: "ProductUpdated", SchemaVersion: 1}
+	eventProductPriceChanged = event.Kind{Type: "ProductPriceChanged", SchemaVersion: 1}
+	eventProductDeleted      = event.Kind{Type: "ProductDeleted", SchemaVersion: 1}
+	eventProductRestored     = event.Kind{Type: "ProductRestored", SchemaVersion: 1}
+)
+
+type priceChange struct {
+	ID       int `json:"id"`
+	OldPrice int `json:"old_price"`
+	NewPrice int `json:"new_price"`
+}
+
+// addUpdateEvents records the events for an update of a product whose price
+// was oldPrice before.
+func addUpdateEvents(ctx context.Context, tx *sql.Tx, oldPrice int, updated Product) error {
+	if err := outbox.Add(ctx, tx, "product", updated.ID, eventProductUpdated, updated); err != nil {
+		return err
+	}
+	if updated.Price == oldPrice {
+		return nil
+	}
+	return outbox.Add(ctx, tx, "product", updated.ID, eventProductPriceChanged, priceChange{ID: updated.ID, OldPrice: oldPrice, NewPrice: updated.Price})
+}
+
+// productColumns lists the products table columns in the order expected by
+// scanProduct.
+const productColumns = "id, name, price, deleted_at, version"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// productErrors validates each writable product field and returns one
+// message per invalid field.
+func productErrors(product Product) []string {
+	var errs []string
+	if product.Name == "" {
+		errs = append(errs, "name must not be empty")
+	}
+	if product.Price <= 0 {
+		errs = append(errs, "price must be positive")
+	}
+	return errs
+}
+
+func scanProduct(row rowScanner) (Product, error) {
+	var product Product
+	err := row.Scan(&product.ID, &product.Name, &product.Price, &product.DeletedAt, &product.Version)
+	return product, err
 }
 
 var (
@@ -71,30 +150,114 @@ func main() { // Read database connection information from environment variables
 		db.Close()
 	}()
 
-	// Initialize Kafka writer
-	serviceLogWriter := initKafkaWriter()
+	// Initialize idempotency key store
+	idempotencyTTL, err := envconfig.Duration("IDEMPOTENCY_TTL", 24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idempotencyKeys := idempotency.NewStore(db, idempotencyTTL)
+	go idempotencyKeys.RunPurge(context.Background(), time.Hour)
+
+	// Initialize purging of soft-deleted products
+	retention, err := envconfig.Duration("SOFT_DELETE_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Products ordered in service1 are kept, so that the orders keep resolving.
+	go softdelete.RunPurge(context.Background(), db, softdelete.Table{
+		Name:  "products",
+		InUse: orderedProducts("http://" + os.Getenv("HELPER_SERVICE")),
+	}, retention, time.Hour)
+
+	// Initialize Kafka delivery settings
+	kafkaConfig, err := kafkaconfig.WriterConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check the Kafka topics in the background, /ready fails while one is missing
+	topicConfig, err := kafkaconfig.TopicConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	topics := []string{os.Getenv("KAFKA_TOPIC"), os.Getenv("KAFKA_EVENTS_TOPIC")}
+	topicCheck := kafkaconfig.NewTopicCheck([]string{os.Getenv("KAFKA_HOST")}, topics, topicConfig)
+	go topicCheck.Run(context.Background(), 30*time.Second)
+
+	// Initialize publishing of access logs. They are queued and written in
+	// batches; LOG_QUEUE_OVERFLOW decides what happens when the queue is full
+	// and those Kafka does not take are kept in LOG_SPOOL_DIR, if set.
+	logQueue, err := producer.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	shutdownTimeout, err := envconfig.Duration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logWriter := initKafkaWriter(kafkaConfig)
+	if err := producer.CheckWriter(logWriter, logQueue); err != nil {
+		log.Fatal(err)
+	}
+	accessLogs := producer.New("access_logs", logWriter, logQueue)
+
+	// Initialize publishing of domain events
+	outboxInterval, err := envconfig.Duration("OUTBOX_POLL_INTERVAL", time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventWriter := initEventWriter(kafkaConfig)
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		outbox.NewRelay(db, eventWriter, serviceName, outboxInterval).Run(relayCtx)
+	}()
 
 	// Initialize HTTP routes
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := topicCheck.Err(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Not ready: %s", err.Error())
+			return
+		}
+		fmt.Fprintf(w, "Ready.")
+	})
 
-	http.HandleFunc("/products", logRequests(serviceLogWriter, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/products", logRequests(accessLogs, func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			getProducts(db, w, r)
 		case http.MethodPost:
-			createProduct(db, w, r)
+			idempotencyKeys.Handle(w, r, func(w http.ResponseWriter, r *http.Request) {
+				createProduct(db, w, r)
+			})
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			fmt.Fprintf(w, "Unsupported request method.")
 		}
 	}))
 
-	http.HandleFunc("/products/", logRequests(serviceLogWriter, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/products/", logRequests(accessLogs, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ":restore") {
+			switch r.Method {
+			case http.MethodPost:
+				restoreProduct(db, w, r)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				fmt.Fprintf(w, "Unsupported request method.")
+			}
+			return
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			getProduct(db, w, r)
 		case http.MethodPut:
 			updateProduct(db, w, r)
+		case http.MethodPatch:
+			patchProduct(db, w, r)
 		case http.MethodDelete:
 			deleteProduct(db, w, r)
 		default:
@@ -104,48 +267,190 @@ func main() { // Read database connection information from environment variables
 	}))
 
 	// Start the HTTP server
-	log.Println("Server listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		log.Println("Server listening on :8080")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for the termination signal, then stop the outbox relay, finish the
+	// open requests and flush the queued access logs
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	<-signalCh
+	log.Println("Shutting down...")
+	stopRelay()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	if err := accessLogs.Close(shutdownCtx); err != nil {
+		log.Println("Access logs were not flushed within", shutdownTimeout)
+	}
+	logWriter.Close()
+
+	// Events of a batch cut short stay pending and are published again
+	select {
+	case <-relayDone:
+	case <-shutdownCtx.Done():
+		log.Println("Outbox relay did not stop within", shutdownTimeout)
+	}
+	eventWriter.Close()
 }
 
-func logRequests(kafkaWriter *kafka.Writer, next http.HandlerFunc) http.HandlerFunc {
+func logRequests(accessLogs *producer.Producer, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Notify broker
-		go func() {
-			logData := map[string]interface{}{
-				"method": r.Method,
-				"path":   r.URL.Path,
-				"ip":     r.RemoteAddr,
-			}
-			logBytes, _ := json.Marshal(logData)
-			kafkaWriter.WriteMessages(
-				context.Background(),
-				kafka.Message{
-					Value: logBytes,
-				},
-			)
-		}()
+		r = r.WithContext(event.WithTraceID(r.Context(), event.RequestTraceID(r)))
+		requestID := accesslog.RequestID(r)
+		w.Header().Set(accesslog.RequestIDHeader, requestID)
+		recorder := accesslog.NewResponseWriter(w)
 
 		httpRequestsTotal.Inc()
-		timer := prometheus.NewTimer(httpRequestDuration)
-		next(w, r)
-		timer.ObserveDuration()
+		start := time.Now()
+		next(recorder, r)
+		duration := time.Since(start)
+		httpRequestDuration.Observe(duration.Seconds())
+
+		// Notify broker once the response is complete
+		e, _ := event.New(r.Context(), serviceName, event.AccessLogKind, accesslog.New(r, recorder, requestID, duration))
+		accessLogs.Publish(e.Message())
 	}
 }
 
-func initKafkaWriter() *kafka.Writer {
+func initKafkaWriter(config kafkaconfig.WriterConfig) *kafka.Writer {
 	brokers := []string{os.Getenv("KAFKA_HOST")}
 	topic := os.Getenv("KAFKA_TOPIC")
-	return kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  brokers,
-		Topic:    topic,
-		Balancer: &kafka.LeastBytes{},
-	})
+	return config.NewWriter(brokers, topic, &kafka.LeastBytes{})
+}
+
+// initEventWriter returns the writer for the domain events topic. Events are
+// keyed by their entity, so the hash balancer keeps the events of an entity
+// in order on one partition. The writer is always synchronous, since the
+// outbox marks events sent once WriteMessages returns.
+func initEventWriter(config kafkaconfig.WriterConfig) *kafka.Writer {
+	config.Async = false
+	return config.NewWriter([]string{os.Getenv("KAFKA_HOST")}, os.Getenv("KAFKA_EVENTS_TOPIC"), &kafka.Hash{})
+}
+
+// parseIDs parses a comma-separated list of product IDs, dropping duplicates.
+func parseIDs(s string) ([]int64, error) {
+	parts := strings.Split(s, ",")
+	ids := make([]int64, 0, len(parts))
+	seen := make(map[int64]bool, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
 }
 
+// orderedProducts returns a softdelete.Table.InUse function asking service1 at
+// baseURL which of the products have been ordered.
+func orderedProducts(baseURL string) func(ctx context.Context, ids []int64) ([]int64, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, ids []int64) ([]int64, error) {
+		var ordered []int64
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > pagination.MaxLimit {
+				n = pagination.MaxLimit
+			}
+			idStrs := make([]string, n)
+			for i, id := range ids[:n] {
+				idStrs[i] = strconv.FormatInt(id, 10)
+			}
+			ids = ids[n:]
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/orders/products?ids="+strings.Join(idStrs, ","), nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			var page struct {
+				ProductIDs []int64 `json:"product_ids"`
+			}
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("GET /orders/products returned %s", resp.Status)
+			} else {
+				err = json.NewDecoder(resp.Body).Decode(&page)
+			}
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			ordered = append(ordered, page.ProductIDs...)
+		}
+		return ordered, nil
+	}
+}
+
+// getProducts handles GET /products. It supports the shared pagination
+// parameters (limit, cursor, sort by id, name or price), the ids, min_price
+// and max_price filters and include_deleted. At most pagination.MaxLimit ids
+// may be requested.
 func getProducts(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	params, err := pagination.ParseParams(query, "name", "price")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid pagination parameters: %s", err.Error())
+		return
+	}
+
+	var conds []string
+	var args []interface{}
+	if !softdelete.IncludeDeleted(r) {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if idsStr := query.Get("ids"); idsStr != "" {
+		ids, err := parseIDs(idsStr)
+		if err != nil || len(ids) > pagination.MaxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid product IDs.")
+			return
+		}
+		args = append(args, pq.Array(ids))
+		conds = append(conds, fmt.Sprintf("id = ANY($%d)", len(args)))
+	}
+	for _, filter := range []struct{ param, op string }{{"min_price", ">="}, {"max_price", "<="}} {
+		v := query.Get(filter.param)
+		if v == "" {
+			continue
+		}
+		price, err := strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid %s.", filter.param)
+			return
+		}
+		args = append(args, price)
+		conds = append(conds, fmt.Sprintf("price %s $%d", filter.op, len(args)))
+	}
+	if cond, keysetArgs := params.Keyset(len(args) + 1); cond != "" {
+		args = append(args, keysetArgs...)
+		conds = append(conds, cond)
+	}
+
+	sqlQuery := "SELECT " + productColumns + " FROM products"
+	if len(conds) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, params.FetchLimit())
+	sqlQuery += fmt.Sprintf(" ORDER BY %s LIMIT $%d", params.OrderBy(), len(args))
+
 	timer := prometheus.NewTimer(dbQueryDuration)
-	rows, err := db.Query("SELECT * FROM products")
+	rows, err := db.Query(sqlQuery, args...)
 	timer.ObserveDuration()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -156,8 +461,8 @@ func getProducts(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 
 	products := make([]Product, 0)
 	for rows.Next() {
-		var product Product
-		if err := rows.Scan(&product.ID, &product.Name, &product.Price); err != nil {
+		product, err := scanProduct(rows)
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "Failed to scan products from the database: %s", err.Error())
 			return
@@ -165,8 +470,18 @@ func getProducts(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		products = append(products, product)
 	}
 
+	page := pagination.New(products, params, func(p Product) (string, int) {
+		switch params.Sort.Field {
+		case "name":
+			return p.Name, p.ID
+		case "price":
+			return strconv.Itoa(p.Price), p.ID
+		}
+		return "", p.ID
+	})
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	json.NewEncoder(w).Encode(page)
 }
 
 func getProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
@@ -179,11 +494,11 @@ func getProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	}
 
 	timer := prometheus.NewTimer(dbQueryDuration)
-	row := db.QueryRow("SELECT * FROM products WHERE id = $1", id)
+	row := db.QueryRow("SELECT "+productColumns+" FROM products WHERE id = $1 AND ($2 OR deleted_at IS NULL)", id, softdelete.IncludeDeleted(r))
 	timer.ObserveDuration()
 
-	var product Product
-	if err := row.Scan(&product.ID, &product.Name, &product.Price); err != nil {
+	product, err := scanProduct(row)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintf(w, "Product not found.")
@@ -194,6 +509,13 @@ func getProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tag := etag.Format(product.Version)
+	w.Header().Set("ETag", tag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etag.MatchWeak(ifNoneMatch, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(product)
 }
@@ -206,21 +528,36 @@ func createProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if product.Name == "" || product.Price <= 0 {
+	if len(productErrors(product)) > 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Invalid product data.")
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to create product in the database: %s", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
 	timer := prometheus.NewTimer(dbQueryDuration)
-	err := db.QueryRow("INSERT INTO products (name, price) VALUES ($1, $2) RETURNING id", product.Name, product.Price).Scan(&product.ID)
+	err = tx.QueryRow("INSERT INTO products (name, price) VALUES ($1, $2) RETURNING id, version", product.Name, product.Price).Scan(&product.ID, &product.Version)
 	timer.ObserveDuration()
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "product", product.ID, eventProductCreated, product)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Failed to create product in the database: %s", err.Error())
 		return
 	}
 
+	w.Header().Set("ETag", etag.Format(product.Version))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(product)
 }
@@ -241,32 +578,206 @@ func updateProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if product.Name == "" || product.Price <= 0 {
+	if len(productErrors(product)) > 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Invalid product data.")
 		return
 	}
 
-	timer := prometheus.NewTimer(dbQueryDuration)
-	result, err := db.Exec("UPDATE products SET name = $1, price = $2 WHERE id = $3", product.Name, product.Price, id)
-	timer.ObserveDuration()
+	expected, ok := productPrecondition(db, w, r, id)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Failed to update product in the database: %s", err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Product not found.")
+	// The old price is read under the row lock so that ProductPriceChanged
+	// events of concurrent updates chain up.
+	var oldPrice int
+	var updated Product
+	timer := prometheus.NewTimer(dbQueryDuration)
+	err = tx.QueryRow("SELECT price FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&oldPrice)
+	if err == nil {
+		row := tx.QueryRow("UPDATE products SET name = $1, price = $2, version = version + 1 WHERE id = $3 AND ($4::int IS NULL OR version = $4) RETURNING "+productColumns, product.Name, product.Price, id, expected)
+		updated, err = scanProduct(row)
+	}
+	timer.ObserveDuration()
+	if err == nil {
+		err = addUpdateEvents(r.Context(), tx, oldPrice, updated)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to update product in the database: %s", err.Error())
+		} else if expected != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, "Product was modified by another request.")
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Product not found.")
+		}
 		return
 	}
 
+	w.Header().Set("ETag", etag.Format(updated.Version))
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Product updated successfully.")
 }
 
+// patchProduct handles PATCH /products/{id} with a JSON Merge Patch (RFC 7386)
+// body and responds with the full updated product.
+func patchProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Path[len("/products/"):]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid product ID.")
+		return
+	}
+
+	if !mergepatch.SupportedContentType(r.Header.Get("Content-Type")) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "Expected %s body.", mergepatch.ContentType)
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid product data.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to update product in the database: %s", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	timer := prometheus.NewTimer(dbQueryDuration)
+	row := tx.QueryRow("SELECT "+productColumns+" FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id)
+	timer.ObserveDuration()
+
+	product, err := scanProduct(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			status := http.StatusNotFound
+			if r.Header.Get("If-Match") != "" {
+				status = http.StatusPreconditionFailed
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "Product not found.")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to get product from the database: %s", err.Error())
+		}
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etag.MatchStrong(ifMatch, etag.Format(product.Version)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "Product was modified by another request.")
+		return
+	}
+
+	current, _ := json.Marshal(product)
+	merged, err := mergepatch.Apply(current, patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid merge patch: %s", err.Error())
+		return
+	}
+
+	var patched Product
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patched); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid product data: %s", err.Error())
+		return
+	}
+
+	errs := productErrors(patched)
+	if patched.ID != product.ID {
+		errs = append(errs, "id is read-only")
+	}
+	if patched.DeletedAt != nil {
+		errs = append(errs, "deleted_at is read-only")
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid product data: %s.", strings.Join(errs, "; "))
+		return
+	}
+
+	timer = prometheus.NewTimer(dbQueryDuration)
+	err = tx.QueryRow("UPDATE products SET name = $1, price = $2, version = version + 1 WHERE id = $3 RETURNING version", patched.Name, patched.Price, id).Scan(&patched.Version)
+	timer.ObserveDuration()
+	if err == nil {
+		err = addUpdateEvents(r.Context(), tx, product.Price, patched)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to update product in the database: %s", err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", etag.Format(patched.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(patched)
+}
+
+// productPrecondition evaluates the If-Match header of r against the stored
+// product. It returns the version a conditional write must still match, or
+// nil when r has no If-Match header. After writing a 412 response it returns
+// false.
+func productPrecondition(db *sql.DB, w http.ResponseWriter, r *http.Request, id int) (*int, bool) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil, true
+	}
+
+	var version int
+	timer := prometheus.NewTimer(dbQueryDuration)
+	err := db.QueryRow("SELECT version FROM products WHERE id = $1 AND deleted_at IS NULL", id).Scan(&version)
+	timer.ObserveDuration()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// If-Match never matches a missing product, not even "*".
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, "Product not found.")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to get product from the database: %s", err.Error())
+		}
+		return nil, false
+	}
+
+	if !etag.MatchStrong(ifMatch, etag.Format(version)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "Product was modified by another request.")
+		return nil, false
+	}
+	return &version, true
+}
+
+// deleteProduct handles DELETE /products/{id}. Products are only marked as
+// deleted, so that existing orders keep resolving, and purged after the
+// retention period unless they have been ordered; see restoreProduct.
 func deleteProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Path[len("/products/"):]
 	id, err := strconv.Atoi(idStr)
@@ -276,22 +787,97 @@ func deleteProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expected, ok := productPrecondition(db, w, r, id)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to delete product from the database: %s", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
 	timer := prometheus.NewTimer(dbQueryDuration)
-	result, err := db.Exec("DELETE FROM products WHERE id = $1", id)
+	row := tx.QueryRow("UPDATE products SET deleted_at = now(), version = version + 1 WHERE id = $1 AND deleted_at IS NULL AND ($2::int IS NULL OR version = $2) RETURNING "+productColumns, id, expected)
 	timer.ObserveDuration()
+
+	product, err := scanProduct(row)
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "product", id, eventProductDeleted, product)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to delete product from the database: %s", err.Error())
+		} else if expected != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, "Product was modified by another request.")
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Product not found.")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Product deleted successfully.")
+}
+
+// restoreProduct handles POST /products/{id}:restore, undoing a soft delete.
+func restoreProduct(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(r.URL.Path[len("/products/"):], ":restore")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid product ID.")
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Failed to delete product from the database: ", err.Error())
+		fmt.Fprintf(w, "Failed to restore product in the database: %s", err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	var product Product
+	timer := prometheus.NewTimer(dbQueryDuration)
+	err = softdelete.Restore(r.Context(), tx, "products", id, productColumns, func(row *sql.Row) (err error) {
+		product, err = scanProduct(row)
+		return err
+	})
+	timer.ObserveDuration()
+
+	switch err {
+	case softdelete.ErrNotDeleted:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Product is not deleted.")
+		return
+	case sql.ErrNoRows:
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Product not found.")
 		return
 	}
+	if err == nil {
+		err = outbox.Add(r.Context(), tx, "product", id, eventProductRestored, product)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to restore product in the database: %s", err.Error())
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Product deleted successfully.")
+	w.Header().Set("ETag", etag.Format(product.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
 }
@@ -0,0 +1,2 @@
+ALTER TABLE products
+ADD COLUMN deleted_at TIMESTAMPTZ;
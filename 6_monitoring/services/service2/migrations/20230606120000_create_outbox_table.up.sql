@@ -0,0 +1,11 @@
+CREATE TABLE outbox (
+  id             BIGSERIAL PRIMARY KEY,
+  aggregate_type TEXT NOT NULL,
+  aggregate_id   TEXT NOT NULL,
+  event_type     TEXT NOT NULL,
+  payload        JSONB NOT NULL,
+  created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+  sent_at        TIMESTAMPTZ
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE outbox
+ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1,
+ADD COLUMN trace_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE idempotency_keys
+ADD COLUMN lease_token CHAR(32);